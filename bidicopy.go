@@ -5,8 +5,34 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"tuntuntun/internal/bufpool"
 )
 
+const DefaultCopyBufferSize = 32 * 1024
+
+type CopyOption func(c *copyConfig)
+
+// WithCopyBufferSize sets the size of the pooled buffers used by BidiCopy.
+func WithCopyBufferSize(size int) CopyOption {
+	return func(c *copyConfig) {
+		if size > 0 {
+			c.bufferSize = size
+		}
+	}
+}
+
+type copyConfig struct {
+	bufferSize int
+}
+
+func copyBuffered(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if canSplice(dst, src) {
+		return io.Copy(dst, src)
+	}
+
+	return bufpool.Copy(dst, src, size)
+}
+
 func closeWrite(c io.ReadWriteCloser) {
 	type closeWriter interface {
 		CloseWrite() error
@@ -18,14 +44,21 @@ func closeWrite(c io.ReadWriteCloser) {
 	}
 }
 
-func BidiCopy(remote, local io.ReadWriteCloser) error {
+func BidiCopy(remote, local io.ReadWriteCloser, opts ...CopyOption) error {
+	cfg := copyConfig{
+		bufferSize: DefaultCopyBufferSize,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	var errs [2]error
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(remote, local)
+		_, err := copyBuffered(remote, local, cfg.bufferSize)
 		if err != nil {
 			errs[0] = fmt.Errorf("bidi copy local->remote: %w", err)
 		}
@@ -34,7 +67,7 @@ func BidiCopy(remote, local io.ReadWriteCloser) error {
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(local, remote)
+		_, err := copyBuffered(local, remote, cfg.bufferSize)
 		if err != nil {
 			errs[1] = fmt.Errorf("bidi copy remote->local: %w", err)
 		}
@@ -0,0 +1,23 @@
+package tuntuntun
+
+import (
+	"io"
+	"net"
+)
+
+// canSplice reports whether the runtime can move data between dst and src
+// with splice(2), without copying it through user space.
+func canSplice(dst io.Writer, src io.Reader) bool {
+	switch dst.(type) {
+	case *net.TCPConn:
+		switch src.(type) {
+		case *net.TCPConn, *net.UnixConn:
+			return true
+		}
+	case *net.UnixConn:
+		_, ok := src.(*net.TCPConn)
+		return ok
+	}
+
+	return false
+}
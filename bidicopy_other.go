@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tuntuntun
+
+import (
+	"io"
+)
+
+func canSplice(dst io.Writer, src io.Reader) bool {
+	return false
+}
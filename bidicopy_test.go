@@ -0,0 +1,174 @@
+package tuntuntun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyBidiCopy is the plain io.Copy implementation, kept as a benchmark baseline.
+func legacyBidiCopy(remote, local io.ReadWriteCloser) error {
+	var errs [2]error
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, errs[0] = io.Copy(remote, local)
+		closeWrite(remote)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, errs[1] = io.Copy(local, remote)
+		closeWrite(local)
+	}()
+
+	wg.Wait()
+
+	return errors.Join(errs[:]...)
+}
+
+func listenPair(t testing.TB, network, addr string) (net.Conn, net.Conn) {
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial(network, l.Addr().String())
+	require.NoError(t, err)
+
+	c2, ok := <-accepted
+	require.True(t, ok)
+
+	return c1, c2
+}
+
+type pairFunc func(t testing.TB) (net.Conn, net.Conn)
+
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	return listenPair(t, "tcp", "127.0.0.1:0")
+}
+
+func unixPair(t testing.TB) (net.Conn, net.Conn) {
+	return listenPair(t, "unix", filepath.Join(t.TempDir(), "sock"))
+}
+
+func pipePair(t testing.TB) (net.Conn, net.Conn) {
+	return net.Pipe()
+}
+
+// tunnel wires client <-> (a, b) <-> server, copying between a and b with copyFn.
+func tunnel(t testing.TB, pair pairFunc, copyFn func(remote, local io.ReadWriteCloser) error) (net.Conn, net.Conn, chan error) {
+	client, a := pair(t)
+	b, server := pair(t)
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer a.Close()
+		defer b.Close()
+
+		errCh <- copyFn(a, b)
+	}()
+
+	return client, server, errCh
+}
+
+func TestBidiCopy(t *testing.T) {
+	for name, pair := range map[string]pairFunc{"tcp": tcpPair, "unix": unixPair} {
+		t.Run(name, func(t *testing.T) {
+			client, server, errCh := tunnel(t, pair, func(remote, local io.ReadWriteCloser) error {
+				return BidiCopy(remote, local, WithCopyBufferSize(1024))
+			})
+			defer client.Close()
+			defer server.Close()
+
+			payload := bytes.Repeat([]byte("0123456789"), 10_000)
+
+			go func() {
+				defer closeWrite(server)
+
+				_, _ = io.Copy(server, server)
+			}()
+
+			go func() {
+				_, _ = client.Write(payload)
+				closeWrite(client)
+			}()
+
+			received, err := io.ReadAll(client)
+			require.NoError(t, err)
+			assert.Equal(t, payload, received)
+
+			client.Close()
+			server.Close()
+			<-errCh
+		})
+	}
+}
+
+func benchmarkCopy(b *testing.B, pair pairFunc, copyFn func(remote, local io.ReadWriteCloser) error) {
+	payload := make([]byte, 256*1024)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		client, server, errCh := tunnel(b, pair, copyFn)
+
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+			server.Close()
+		}()
+
+		_, err := client.Write(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		closeWrite(client)
+
+		<-errCh
+		client.Close()
+	}
+}
+
+func BenchmarkBidiCopy(b *testing.B) {
+	impls := []struct {
+		name string
+		fn   func(remote, local io.ReadWriteCloser) error
+	}{
+		{"legacy", legacyBidiCopy},
+		{"pooled", func(remote, local io.ReadWriteCloser) error {
+			return BidiCopy(remote, local)
+		}},
+	}
+
+	for _, transport := range []struct {
+		name string
+		pair pairFunc
+	}{{"tcp", tcpPair}, {"unix", unixPair}, {"pipe", pipePair}} {
+		for _, impl := range impls {
+			b.Run(fmt.Sprintf("%v/%v", transport.name, impl.name), func(b *testing.B) {
+				benchmarkCopy(b, transport.pair, impl.fn)
+			})
+		}
+	}
+}
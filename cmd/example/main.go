@@ -5,19 +5,24 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
 	"tuntuntun"
+	"tuntuntun/tuntunauto"
 	"tuntuntun/tuntunfwd"
+	"tuntuntun/tuntunh1"
 	"tuntuntun/tuntunh2"
 	"tuntuntun/tuntunhttp"
 	"tuntuntun/tuntunmux"
 	"tuntuntun/tuntunopener"
+	"tuntuntun/tuntunstdio"
 	"tuntuntun/tuntunws"
 
 	"golang.org/x/net/http2"
@@ -35,8 +40,11 @@ func main() {
 	switch args[0] {
 	case "client":
 		addr := flag.String("addr", "https://localhost:1234", "server address")
-		transport := flag.String("transport", "ws", "http transport [ws, h2]")
+		transport := flag.String("transport", "ws", "transport [ws, h2, h1, auto, stdio]")
+		command := flag.String("command", "", "command serving the stdio transport, e.g. \"ssh bastion example serve-stdio\"")
 		mux := flag.Bool("mux", true, "enable mux")
+		wsH2 := flag.Bool("ws-h2", false, "run ws over http2 extended connect, requires GODEBUG=http2xconnect=1 on the server")
+		allowUnix := flag.Bool("allow-unix", false, "allow the server to reach unix sockets, e.g. /var/run/docker.sock")
 		flag.CommandLine.Parse(args[1:])
 
 		u, err := url.Parse(*addr)
@@ -47,9 +55,25 @@ func main() {
 		var opener tuntuntun.Opener
 		switch *transport {
 		case "h2":
-			opener = tuntunh2.NewClient(u.String())
+			var opts []tuntunh2.ClientOption
+			if u.Scheme == "http" {
+				opts = append(opts, tuntunh2.WithH2C())
+			}
+
+			opener = tuntunh2.NewClient(u.String(), opts...)
 		case "ws":
-			opener = tuntunws.NewClient(u.String())
+			var opts []tuntunws.ClientOption
+			if *wsH2 {
+				opts = append(opts, tuntunws.WithHTTP2(nil))
+			}
+
+			opener = tuntunws.NewClient(u.String(), opts...)
+		case "h1":
+			opener = tuntunh1.NewClient(u.String())
+		case "auto":
+			opener = tuntunauto.NewClient(u.String(), tuntunauto.WithClientLogger(slog.Default()))
+		case "stdio":
+			opener = tuntunstdio.NewClient(strings.Fields(*command))
 		default:
 			log.Fatal(fmt.Sprintf("unknown transport %q", *transport))
 		}
@@ -62,11 +86,9 @@ func main() {
 		}
 
 		cfg := tuntunfwd.Config{
-			LocalDial: func(ctx context.Context, addr string) (net.Conn, error) {
-				return net.Dial("tcp4", addr)
-			},
-			LocalListen: func(ctx context.Context, addr string) (net.Listener, error) {
-				return net.Listen("tcp4", addr)
+			LocalDial: localDial(*allowUnix),
+			LocalListen: func(ctx context.Context, network, addr string) (net.Listener, error) {
+				return net.Listen(network, addr)
 			},
 			Logger: slog.Default(),
 		}
@@ -93,40 +115,33 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-	case "server":
-		addr := flag.String("addr", ":1234", "http server address")
+	case "serve-stdio":
 		allowForward := flag.Bool("allow-forward", false, "allow forwarding request")
-		remoteAddrs := flag.String("remote-addrs", "", "comma-separated addresses to request forwarding")
-		transport := flag.String("transport", "ws", "http transport [ws, h2]")
+		allowUnix := flag.Bool("allow-unix", false, "allow forwarding requests to unix sockets, requires -allow-forward")
+		remoteAddrs := flag.String("remote-addrs", "", "comma-separated addresses to request forwarding, e.g. localhost:5432 or unix:/tmp/docker.sock=unix:/var/run/docker.sock")
 		mux := flag.Bool("mux", true, "enable mux")
 		flag.CommandLine.Parse(args[1:])
 
-		var handler tuntuntun.Handler = tuntunfwd.NewServer(func() (tuntunopener.PeerHandler, error) {
-			return tuntunfwd.DefaultPeerHandler(
-				tuntunfwd.Config{
-					LocalDial: func(ctx context.Context, addr string) (net.Conn, error) {
-						if *allowForward {
-							return net.Dial("tcp4", addr)
-						} else {
-							return nil, errors.New("denied by cli")
-						}
-
-					},
-					LocalListen: func(ctx context.Context, addr string) (net.Listener, error) {
-						return net.Listen("tcp4", addr)
-					},
-					Logger: slog.Default(),
-				},
-				strings.Split(*remoteAddrs, ","),
-				func(ctx context.Context, raddr, laddr string) {
-					fmt.Printf("[%v] Listening on %v\n", raddr, laddr)
-				},
-			), nil
-		})
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
 
-		if *mux {
-			handler = tuntunmux.NewServer(handler, tuntunmux.WithServerLogger(slog.Default()))
+		// stdout carries the conn
+		handler := serverHandler(*allowForward, *allowUnix, *remoteAddrs, *mux, os.Stderr)
+
+		err := tuntunstdio.NewServer(handler, tuntunstdio.WithLogger(slog.Default())).ServeStdio(ctx)
+		if err != nil {
+			log.Fatal(err)
 		}
+	case "server":
+		addr := flag.String("addr", ":1234", "http server address")
+		allowForward := flag.Bool("allow-forward", false, "allow forwarding request")
+		allowUnix := flag.Bool("allow-unix", false, "allow forwarding requests to unix sockets, requires -allow-forward")
+		remoteAddrs := flag.String("remote-addrs", "", "comma-separated addresses to request forwarding, e.g. localhost:5432 or unix:/tmp/docker.sock=unix:/var/run/docker.sock")
+		transport := flag.String("transport", "ws", "http transport [ws, h2, h1, auto]")
+		mux := flag.Bool("mux", true, "enable mux")
+		flag.CommandLine.Parse(args[1:])
+
+		handler := serverHandler(*allowForward, *allowUnix, *remoteAddrs, *mux, os.Stdout)
 
 		var httpHandler http.Handler
 		switch *transport {
@@ -134,18 +149,27 @@ func main() {
 			httpHandler = tuntunh2.NewServer(handler, tuntunh2.WithLogger(slog.Default()))
 		case "ws":
 			httpHandler = tuntunws.NewServer(handler, tuntunws.WithLogger(slog.Default()))
+		case "h1":
+			httpHandler = tuntunh1.NewServer(handler, tuntunh1.WithLogger(slog.Default()))
+		case "auto":
+			httpHandler = tuntunauto.NewServer(handler, tuntunauto.WithLogger(slog.Default()))
 		default:
 			log.Fatal(fmt.Sprintf("unknown transport %q", *transport))
 		}
 
 		httpHandler = tuntunhttp.Middleware(httpHandler)
 
-		if *transport == "h2" {
+		// ws may also run over h2c extended connect
+		if *transport == "h2" || *transport == "ws" || *transport == "auto" {
 			h2s := &http2.Server{
 				MaxConcurrentStreams: 250,
 			}
 
 			httpHandler = h2c.NewHandler(httpHandler, h2s)
+
+			if *transport != "h2" && !tuntunws.ExtendedConnectEnabled() {
+				slog.Warn("ws over http2 is disabled, clients fall back to http/1.1 unless the server runs with GODEBUG=http2xconnect=1")
+			}
 		}
 
 		err := http.ListenAndServe(*addr, httpHandler)
@@ -156,3 +180,51 @@ func main() {
 		log.Fatal(fmt.Sprintf("unknown command %q", os.Args[1]))
 	}
 }
+
+// serverHandler serves the forwarding requests of clients, printing the
+// listening addresses to out.
+func serverHandler(allowForward, allowUnix bool, remoteAddrs string, mux bool, out io.Writer) tuntuntun.Handler {
+	dial := localDial(allowUnix)
+
+	var handler tuntuntun.Handler = tuntunfwd.NewServer(func() (tuntunopener.PeerHandler, error) {
+		return tuntunfwd.DefaultPeerHandler(
+			tuntunfwd.Config{
+				LocalDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if allowForward {
+						return dial(ctx, network, addr)
+					} else {
+						return nil, errors.New("denied by cli")
+					}
+
+				},
+				LocalListen: func(ctx context.Context, network, addr string) (net.Listener, error) {
+					return net.Listen(network, addr)
+				},
+				Logger: slog.Default(),
+			},
+			strings.Split(remoteAddrs, ","),
+			func(ctx context.Context, raddr, laddr string) {
+				fmt.Fprintf(out, "[%v] Listening on %v\n", raddr, laddr)
+			},
+		), nil
+	})
+
+	if mux {
+		handler = tuntunmux.NewServer(handler, tuntunmux.WithServerLogger(slog.Default()))
+	}
+
+	return handler
+}
+
+// localDial dials the addresses the peer forwards to, unix sockets such as
+// /var/run/docker.sock are only reachable when allowUnix is set.
+func localDial(allowUnix bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(network, "unix") && !allowUnix {
+			return nil, errors.New("unix sockets denied by cli, see -allow-unix")
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -5,14 +5,18 @@ go 1.24
 require (
 	github.com/coder/websocket v1.8.13
 	github.com/hashicorp/yamux v0.1.2
+	github.com/quic-go/quic-go v0.56.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.41.0
 	golang.org/x/net v0.43.0
 	golang.org/x/sync v0.16.0
+	golang.org/x/time v0.12.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
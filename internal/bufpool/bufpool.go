@@ -0,0 +1,52 @@
+// Package bufpool pools the copy buffers, so that each conn does not allocate
+// its own.
+package bufpool
+
+import (
+	"io"
+	"sync"
+)
+
+var pools sync.Map // map[int]*sync.Pool
+
+func Get(size int) *[]byte {
+	p, ok := pools.Load(size)
+	if !ok {
+		p, _ = pools.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				b := make([]byte, size)
+				return &b
+			},
+		})
+	}
+
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func Put(b *[]byte) {
+	p, ok := pools.Load(len(*b))
+	if !ok {
+		return
+	}
+
+	p.(*sync.Pool).Put(b)
+}
+
+// Hide ReaderFrom/WriterTo so that io.CopyBuffer uses the pooled buffer instead
+// of falling back to an allocating generic copy.
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// Copy copies from src to dst through a pooled buffer of size bytes, each write
+// to dst is at most size bytes.
+func Copy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	buf := Get(size)
+	defer Put(buf)
+
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
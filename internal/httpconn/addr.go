@@ -0,0 +1,19 @@
+// Package httpconn holds the pieces shared by the transports carrying conns
+// over HTTP requests.
+package httpconn
+
+import (
+	"net"
+	"net/netip"
+)
+
+// ParseAddr parses a "host:port" address as reported by net/http, falling back
+// to fallback.
+func ParseAddr(addr string, fallback net.Addr) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return fallback
+	}
+
+	return net.TCPAddrFromAddrPort(ap)
+}
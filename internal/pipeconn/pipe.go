@@ -0,0 +1,174 @@
+// Package pipeconn gives deadlines to the streams that have none of their own,
+// such as HTTP bodies or SSH channels. Reads and writes go through in-memory
+// pipes pumped from and to the streams, so that a deadline only interrupts the
+// pending calls in its direction and can be extended once passed, as with any
+// net.Conn.
+package pipeconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"tuntuntun/internal/bufpool"
+)
+
+// BufferSize is the size of the pooled buffers of the pumps, the pump of a
+// PipeWriter writes at most BufferSize bytes at once.
+const BufferSize = 32 * 1024
+
+// PipeReader reads a stream body through a pipe fed by a goroutine, the body
+// is only read from while the pipe is.
+type PipeReader struct {
+	net.Conn
+	body io.ReadCloser
+
+	done chan struct{}
+	// err ended the body, set before done is closed
+	err error
+}
+
+// NewPipeReader starts pumping body, which is closed along with the reader.
+func NewPipeReader(body io.ReadCloser) *PipeReader {
+	pr, pw := net.Pipe()
+
+	r := &PipeReader{
+		Conn: pr,
+		body: body,
+		done: make(chan struct{}),
+	}
+	go r.pump(pw)
+
+	return r
+}
+
+func (r *PipeReader) pump(pw net.Conn) {
+	_, err := bufpool.Copy(pw, r.body, BufferSize)
+	if err == nil {
+		err = io.EOF
+	}
+	r.err = err
+	close(r.done)
+
+	_ = pw.Close()
+}
+
+func (r *PipeReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if err == io.EOF {
+		<-r.done
+		err = r.err
+	}
+
+	return n, err
+}
+
+func (r *PipeReader) Close() error {
+	err1 := r.Conn.Close()
+	err2 := r.body.Close()
+
+	return errors.Join(err1, err2)
+}
+
+// PipeWriter writes to a stream through a pipe. Its other end is either read by
+// the stream itself, as the body of a request, or pumped by a goroutine into a
+// stream writer.
+type PipeWriter struct {
+	net.Conn
+
+	// w is the stream writer the pump goroutine writes to, nil when the pipe is
+	// read by the stream.
+	w    io.WriteCloser
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewBodyPipe returns a PipeWriter and the other end of its pipe, to be read by
+// the stream.
+func NewBodyPipe() (*PipeWriter, io.ReadCloser) {
+	pr, pw := net.Pipe()
+
+	return &PipeWriter{Conn: pw}, pr
+}
+
+// NewPipeWriter starts pumping to w, which is closed along with the writer.
+func NewPipeWriter(w io.WriteCloser) *PipeWriter {
+	pr, pw := net.Pipe()
+
+	pwr := &PipeWriter{
+		Conn: pw,
+		w:    w,
+		done: make(chan struct{}),
+	}
+	go pwr.pump(pr)
+
+	return pwr
+}
+
+func (w *PipeWriter) pump(pr net.Conn) {
+	defer close(w.done)
+
+	_, err := bufpool.Copy(w.w, pr, BufferSize)
+	if err != nil {
+		w.CloseWithError(err)
+	}
+}
+
+// CloseWithError closes the pipe, the pending and next writes fail with err.
+func (w *PipeWriter) CloseWithError(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+
+	_ = w.Conn.Close()
+}
+
+func (w *PipeWriter) Write(p []byte) (int, error) {
+	n, err := w.Conn.Write(p)
+	if errors.Is(err, io.ErrClosedPipe) {
+		w.mu.Lock()
+		if w.err != nil {
+			err = w.err
+		}
+		w.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// Flush closes the pipe and waits for what was written to be pumped.
+func (w *PipeWriter) Flush() {
+	_ = w.Conn.Close()
+
+	if w.done != nil {
+		<-w.done
+	}
+}
+
+func (w *PipeWriter) CloseWrite() error {
+	w.Flush()
+
+	if w.w == nil {
+		return nil
+	}
+
+	if cw, ok := w.w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return w.w.Close()
+}
+
+func (w *PipeWriter) Close() error {
+	w.Flush()
+
+	if w.w == nil {
+		return nil
+	}
+
+	return w.w.Close()
+}
@@ -0,0 +1,263 @@
+package tuntunauto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+	"tuntuntun"
+	"tuntuntun/tuntunh1"
+	"tuntuntun/tuntunh2"
+	"tuntuntun/tuntunws"
+)
+
+// Transport is a named way of opening conns to the server.
+type Transport struct {
+	Name   string
+	Opener tuntuntun.Opener
+}
+
+type ClientOption func(c *Client)
+
+// WithTransports sets the transports to probe, in order of preference. Defaults
+// to h2, ws and h1.
+func WithTransports(ts ...Transport) ClientOption {
+	return func(c *Client) {
+		c.transports = ts
+	}
+}
+
+// WithProbeTimeout sets how long a transport may take to open a conn while
+// probing before the next one is tried, 10s by default. Zero waits as long as
+// the context of Open.
+func WithProbeTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.probeTimeout = d
+	}
+}
+
+func WithClientLogger(l *slog.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// NewClient returns an Opener using the first transport able to open a conn to
+// the server at url, as served by Server. The selected transport is used until
+// it fails to open a conn, the transports are then probed again.
+func NewClient(rawURL string, opts ...ClientOption) *Client {
+	c := &Client{
+		probeTimeout: 10 * time.Second,
+		selected:     -1,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.transports == nil {
+		c.transports = DefaultTransports(rawURL)
+	}
+
+	return c
+}
+
+// DefaultTransports returns the h2, ws and h1 transports to the server at url.
+func DefaultTransports(rawURL string) []Transport {
+	var h2Opts []tuntunh2.ClientOption
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme == "http" {
+		h2Opts = append(h2Opts, tuntunh2.WithH2C())
+	}
+
+	return []Transport{
+		{Name: "h2", Opener: tuntunh2.NewClient(rawURL, h2Opts...)},
+		{Name: "ws", Opener: tuntunws.NewClient(rawURL)},
+		{Name: "h1", Opener: tuntunh1.NewClient(rawURL)},
+	}
+}
+
+type Client struct {
+	transports   []Transport
+	probeTimeout time.Duration
+	logger       *slog.Logger
+
+	mu       sync.Mutex
+	selected int
+	probing  *probeCall
+}
+
+// probeCall is a probe in flight, concurrent Opens wait for its outcome instead
+// of probing on their own.
+type probeCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Selected returns the name of the transport in use, empty until a transport
+// was selected.
+func (c *Client) Selected() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.selected < 0 {
+		return ""
+	}
+
+	return c.transports[c.selected].Name
+}
+
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	for {
+		c.mu.Lock()
+		selected, p := c.selected, c.probing
+		if selected < 0 && p == nil {
+			p = &probeCall{done: make(chan struct{})}
+			c.probing = p
+			c.mu.Unlock()
+
+			conn, err := c.probe(ctx)
+
+			c.mu.Lock()
+			p.err = err
+			c.probing = nil
+			c.mu.Unlock()
+			close(p.done)
+
+			return conn, err
+		}
+		c.mu.Unlock()
+
+		if selected < 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-p.done:
+			}
+
+			if errors.Is(p.err, context.Canceled) || errors.Is(p.err, context.DeadlineExceeded) {
+				// the probing Open gave up, try again with our own context
+				continue
+			}
+			if p.err != nil {
+				return nil, p.err
+			}
+
+			continue
+		}
+
+		conn, err := c.transports[selected].Opener.Open(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if c.logger != nil {
+			c.logger.Log(ctx, slog.LevelWarn, "auto: transport failed, probing", slog.String("transport", c.transports[selected].Name), slog.String("err", err.Error()))
+		}
+
+		c.mu.Lock()
+		if c.selected == selected {
+			c.selected = -1
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) probe(ctx context.Context) (net.Conn, error) {
+	var errs []error
+	for i, t := range c.transports {
+		conn, err := c.try(ctx, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			errs = append(errs, fmt.Errorf("%v: %w", t.Name, err))
+			continue
+		}
+
+		if c.logger != nil {
+			c.logger.Log(ctx, slog.LevelInfo, "auto: selected transport", slog.String("transport", t.Name))
+		}
+
+		c.mu.Lock()
+		c.selected = i
+		c.mu.Unlock()
+
+		return conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// try opens a conn with t, giving up after the probe timeout. The conns of some
+// transports live as long as the context they were opened with, it is cancelled
+// once the conn is closed.
+func (c *Client) try(ctx context.Context, t Transport) (net.Conn, error) {
+	if c.probeTimeout <= 0 {
+		return t.Opener.Open(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resCh := make(chan result, 1)
+
+	go func() {
+		conn, err := t.Opener.Open(ctx)
+		resCh <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(c.probeTimeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			cancel()
+			return nil, res.err
+		}
+
+		return &conn{Conn: res.conn, cancel: cancel}, nil
+	case <-timer.C:
+		cancel()
+
+		go func() {
+			res := <-resCh
+			if res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("probe timed out after %v", c.probeTimeout)
+	}
+}
+
+// conn cancels the context it was opened with once closed.
+type conn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.cancel()
+
+	return err
+}
+
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
@@ -0,0 +1,66 @@
+package tuntunauto
+
+import (
+	"log/slog"
+	"net/http"
+	"tuntuntun"
+	"tuntuntun/tuntunh1"
+	"tuntuntun/tuntunh2"
+	"tuntuntun/tuntunws"
+)
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// Server serves every transport from a single url, the h2 transport requires it
+// to be served over HTTP/2, either TLS or h2c.
+type Server struct {
+	logger *slog.Logger
+
+	h2 http.Handler
+	ws http.Handler
+	h1 http.Handler
+}
+
+func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var (
+		h2Opts []tuntunh2.Option
+		wsOpts []tuntunws.Option
+		h1Opts []tuntunh1.Option
+	)
+	if s.logger != nil {
+		h2Opts = append(h2Opts, tuntunh2.WithLogger(s.logger))
+		wsOpts = append(wsOpts, tuntunws.WithLogger(s.logger))
+		h1Opts = append(h1Opts, tuntunh1.WithLogger(s.logger))
+	}
+
+	s.h2 = tuntunh2.NewServer(handler, h2Opts...)
+	s.ws = tuntunws.NewServer(handler, wsOpts...)
+	s.h1 = tuntunh1.NewServer(handler, h1Opts...)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case tuntunws.IsRequest(r):
+		s.ws.ServeHTTP(w, r)
+	case tuntunh1.IsRequest(r):
+		// checked before h2, its requests may also come over HTTP/2
+		s.h1.ServeHTTP(w, r)
+	case r.ProtoMajor >= 2 && r.Method == http.MethodPost:
+		s.h2.ServeHTTP(w, r)
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
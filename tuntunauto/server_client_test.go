@@ -0,0 +1,230 @@
+package tuntunauto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tuntuntun"
+	"tuntuntun/tuntunh1"
+	"tuntuntun/tuntunws"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(ctx context.Context, conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write([]byte("said: " + string(buf)))
+
+	return err
+}
+
+func roundtrip(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("said: hello"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, "said: hello", string(buf))
+}
+
+// network mimics the environment between the client and the server.
+type network struct {
+	h2 atomic.Bool
+	ws atomic.Bool
+
+	h2Requests atomic.Int64
+}
+
+func newServer(t *testing.T, n *network) *httptest.Server {
+	h := NewServer(tuntuntun.HandlerFunc(echo))
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor >= 2 {
+			n.h2Requests.Add(1)
+			if !n.h2.Load() {
+				http.Error(w, "no h2", http.StatusBadGateway)
+				return
+			}
+		}
+
+		if tuntunws.IsRequest(r) && !n.ws.Load() {
+			http.Error(w, "no upgrade", http.StatusBadGateway)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestSelect(t *testing.T) {
+	for _, tc := range []struct {
+		h2, ws   bool
+		expected string
+	}{
+		{true, true, "h2"},
+		{false, true, "ws"},
+		{false, false, "h1"},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			n := &network{}
+			n.h2.Store(tc.h2)
+			n.ws.Store(tc.ws)
+
+			srv := newServer(t, n)
+
+			c := NewClient(srv.URL)
+
+			for range 3 {
+				conn, err := c.Open(t.Context())
+				require.NoError(t, err)
+
+				roundtrip(t, conn)
+				conn.Close()
+
+				assert.Equal(t, tc.expected, c.Selected())
+			}
+		})
+	}
+}
+
+func TestReprobe(t *testing.T) {
+	n := &network{}
+	n.ws.Store(true)
+
+	srv := newServer(t, n)
+
+	c := NewClient(srv.URL)
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	roundtrip(t, conn)
+	conn.Close()
+
+	assert.Equal(t, "ws", c.Selected())
+	probes := n.h2Requests.Load()
+
+	// the selection is cached
+	conn, err = c.Open(t.Context())
+	require.NoError(t, err)
+	roundtrip(t, conn)
+	conn.Close()
+
+	assert.Equal(t, probes, n.h2Requests.Load())
+
+	// ws breaks, h2 is back
+	n.ws.Store(false)
+	n.h2.Store(true)
+
+	conn, err = c.Open(t.Context())
+	require.NoError(t, err)
+	roundtrip(t, conn)
+	conn.Close()
+
+	assert.Equal(t, "h2", c.Selected())
+}
+
+func TestProbeTimeout(t *testing.T) {
+	n := &network{}
+	n.ws.Store(true)
+
+	srv := newServer(t, n)
+
+	stuck := tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	c := NewClient(srv.URL,
+		WithTransports(
+			Transport{Name: "stuck", Opener: stuck},
+			Transport{Name: "h1", Opener: tuntunh1.NewClient(srv.URL)},
+		),
+		WithProbeTimeout(50*time.Millisecond),
+	)
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn)
+	assert.Equal(t, "h1", c.Selected())
+}
+
+func TestUnsupportedRequest(t *testing.T) {
+	n := &network{}
+	srv := newServer(t, n)
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), "unsupported"))
+}
+
+func TestProbeSingleFlight(t *testing.T) {
+	n := &network{}
+	n.ws.Store(true)
+
+	srv := newServer(t, n)
+
+	var probes atomic.Int64
+	slow := tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+		probes.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("unsupported")
+	})
+
+	c := NewClient(srv.URL,
+		WithTransports(
+			Transport{Name: "slow", Opener: slow},
+			Transport{Name: "h1", Opener: tuntunh1.NewClient(srv.URL)},
+		),
+	)
+
+	var g errgroup.Group
+	for range 10 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn)
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	// the concurrent Opens shared a single probe
+	assert.EqualValues(t, 1, probes.Load())
+	assert.Equal(t, "h1", c.Selected())
+}
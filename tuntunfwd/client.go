@@ -6,12 +6,18 @@ import (
 	"net"
 	"tuntuntun"
 	"tuntuntun/tuntunopener"
+	"tuntuntun/tuntunrate"
 )
 
 type Config struct {
-	LocalDial   func(ctx context.Context, addr string) (net.Conn, error)
-	LocalListen func(ctx context.Context, addr string) (net.Listener, error)
+	// LocalDial dials a forwarded address over one of Networks.
+	LocalDial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	LocalListen func(ctx context.Context, network, addr string) (net.Listener, error)
 	Logger      *slog.Logger
+	// Limiter throttles forwarded conns. Each handler returned by
+	// DefaultPeerHandler is a peer, so the per-peer limits apply to all the conns
+	// forwarded to or from a peer, whatever their address.
+	Limiter *tuntunrate.Limiter
 }
 
 type Client struct {
@@ -0,0 +1,74 @@
+package tuntunfwd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"tuntuntun"
+)
+
+// MaxPacketSize is the largest unixpacket packet forwarded, larger packets are
+// truncated when read from the local conn.
+const MaxPacketSize = 64 * 1024
+
+// packetConn keeps packet boundaries over a stream, by prefixing each write
+// with its length. Each read returns a single packet.
+type packetConn struct {
+	io.ReadWriteCloser
+}
+
+func (c *packetConn) Read(p []byte) (int, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(c.ReadWriteCloser, hdr[:])
+	if err != nil {
+		return 0, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > MaxPacketSize {
+		return 0, fmt.Errorf("packet too large: %d", size)
+	}
+	if int(size) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+
+	n, err := io.ReadFull(c.ReadWriteCloser, p[:size])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (c *packetConn) Write(p []byte) (int, error) {
+	if len(p) > MaxPacketSize {
+		return 0, fmt.Errorf("packet too large: %d", len(p))
+	}
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	_, err := c.ReadWriteCloser.Write(hdr[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return c.ReadWriteCloser.Write(p)
+}
+
+func (c *packetConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// forwardCopy copies between the tunnel conn and the local conn, packet by
+// packet for unixpacket.
+func forwardCopy(network string, rconn, lconn io.ReadWriteCloser) error {
+	if network != "unixpacket" {
+		return tuntuntun.BidiCopy(rconn, lconn)
+	}
+
+	return tuntuntun.BidiCopy(&packetConn{ReadWriteCloser: rconn}, lconn, tuntuntun.WithCopyBufferSize(MaxPacketSize))
+}
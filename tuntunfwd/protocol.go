@@ -4,18 +4,77 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
 )
 
 const V1 = 1
 
+// Networks are the networks an address may be forwarded over, as understood by
+// net.Dial. unixpacket conns are forwarded packet by packet, see MaxPacketSize.
+var Networks = []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket"}
+
+// unsupportedNetworks are the networks of net.Dial that cannot be forwarded.
+var unsupportedNetworks = []string{"udp", "udp4", "udp6", "ip", "ip4", "ip6", "unixgram"}
+
 type Message struct {
-	Version int    `json:"version"`
+	Version int `json:"version"`
+	// Network defaults to tcp, for peers predating it.
+	Network string `json:"network,omitempty"`
 	Addr    string `json:"addr"`
 }
 
-func WriteInit(conn io.Writer, addr string) error {
+// ParseAddr splits an address prefixed by its network, e.g.
+// unix:/var/run/docker.sock or tcp6:[::1]:5432. Addresses without a known
+// network prefix are tcp, networks that cannot be forwarded such as udp are an
+// error. On Linux, unix:@name is an abstract socket.
+func ParseAddr(s string) (network, addr string, err error) {
+	network, addr, ok := strings.Cut(s, ":")
+	if ok && slices.Contains(Networks, network) {
+		return network, addr, nil
+	}
+
+	if ok && slices.Contains(unsupportedNetworks, network) {
+		return "", "", fmt.Errorf("unsupported network: %q", network)
+	}
+
+	return "tcp", s, nil
+}
+
+// forward is an address forwarded from a local listener to the peer.
+type forward struct {
+	listenNetwork, listenAddr string
+	network, addr             string
+}
+
+// parseForward parses an address as understood by ParseAddr, optionally
+// preceded by the local address to listen on and "=", e.g.
+// unix:/tmp/docker.sock=unix:/var/run/docker.sock. The listener defaults to a
+// random tcp port.
+func parseForward(s string) (forward, error) {
+	f := forward{listenNetwork: "tcp", listenAddr: ":0"}
+
+	var err error
+	if laddr, raddr, ok := strings.Cut(s, "="); ok {
+		f.listenNetwork, f.listenAddr, err = ParseAddr(laddr)
+		if err != nil {
+			return f, err
+		}
+		s = raddr
+	}
+
+	f.network, f.addr, err = ParseAddr(s)
+	if err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+func WriteInit(conn io.Writer, network, addr string) error {
 	return json.NewEncoder(conn).Encode(Message{
 		Version: V1,
+		Network: network,
 		Addr:    addr,
 	})
 }
@@ -31,6 +90,14 @@ func ReadInit(conn io.Reader) (Message, error) {
 		return msg, fmt.Errorf("unexpected version: %d", msg.Version)
 	}
 
+	if msg.Network == "" {
+		msg.Network = "tcp"
+	}
+
+	if !slices.Contains(Networks, msg.Network) {
+		return msg, fmt.Errorf("unsupported network: %q", msg.Network)
+	}
+
 	if msg.Addr == "" {
 		return msg, fmt.Errorf("missing addr")
 	}
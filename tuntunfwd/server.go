@@ -6,6 +6,8 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"tuntuntun"
 	"tuntuntun/tuntunopener"
 )
@@ -15,8 +17,19 @@ type Server struct {
 	server *tuntunopener.Server
 }
 
-func runListener(ctx context.Context, cfg Config, h *tuntunopener.PeerDescriptor, raddr string, onListen func(ctx context.Context, raddr, laddr string)) {
-	l, err := cfg.LocalListen(ctx, ":0")
+// peerSeq numbers the peer handlers, to key their per-peer limits.
+var peerSeq atomic.Uint64
+
+func runListener(ctx context.Context, cfg Config, h *tuntunopener.PeerDescriptor, peer, raddr string, onListen func(ctx context.Context, raddr, laddr string)) {
+	f, err := parseForward(raddr)
+	if err != nil {
+		if cfg.Logger != nil {
+			cfg.Logger.Log(ctx, slog.LevelError, "failed to parse forward", slog.String("err", err.Error()))
+		}
+		return
+	}
+
+	l, err := cfg.LocalListen(ctx, f.listenNetwork, f.listenAddr)
 	if err != nil {
 		if cfg.Logger != nil {
 			cfg.Logger.Log(ctx, slog.LevelError, "failed to listen", slog.String("err", err.Error()))
@@ -44,15 +57,18 @@ func runListener(ctx context.Context, cfg Config, h *tuntunopener.PeerDescriptor
 
 		go func() {
 			err := h.Open(ctx, tuntuntun.HandlerFunc(func(ctx context.Context, rconn io.ReadWriteCloser) error {
+				if cfg.Limiter != nil {
+					rconn = cfg.Limiter.Wrap(ctx, peer, rconn)
+				}
 				defer rconn.Close()
 				defer lconn.Close()
 
-				err := WriteInit(rconn, raddr)
+				err := WriteInit(rconn, f.network, f.addr)
 				if err != nil {
 					return err
 				}
 
-				return tuntuntun.BidiCopy(rconn, lconn)
+				return forwardCopy(f.network, rconn, lconn)
 			}))
 			if err != nil {
 				lconn.Close()
@@ -64,11 +80,19 @@ func runListener(ctx context.Context, cfg Config, h *tuntunopener.PeerDescriptor
 	}
 }
 
+// DefaultPeerHandler forwards the addresses of autoForward, as parsed by
+// ParseAddr, from a local listener to the peer, and dials the addresses the
+// peer forwards. An address may be preceded by the address to listen on and
+// "=", e.g. unix:/tmp/docker.sock=unix:/var/run/docker.sock, the listener
+// defaults to a random tcp port.
 func DefaultPeerHandler(cfg Config, autoForward []string, onListen func(ctx context.Context, raddr, laddr string)) tuntunopener.PeerHandler {
+	// the server creates a handler per peer, the client has a single peer
+	peer := "peer-" + strconv.FormatUint(peerSeq.Add(1), 10)
+
 	return tuntunopener.PeerHandlerFunc{
 		OnPeerFunc: func(ctx context.Context, h *tuntunopener.PeerDescriptor) {
 			for _, addr := range autoForward {
-				go runListener(ctx, cfg, h, addr, onListen)
+				go runListener(ctx, cfg, h, peer, addr, onListen)
 			}
 		},
 		ServeConnFunc: func(ctx context.Context, rconn io.ReadWriteCloser) error {
@@ -79,13 +103,18 @@ func DefaultPeerHandler(cfg Config, autoForward []string, onListen func(ctx cont
 				return err
 			}
 
-			lconn, err := cfg.LocalDial(ctx, msg.Addr)
+			lconn, err := cfg.LocalDial(ctx, msg.Network, msg.Addr)
 			if err != nil {
 				return err
 			}
 			defer lconn.Close()
 
-			return tuntuntun.BidiCopy(rconn, lconn)
+			if cfg.Limiter != nil {
+				rconn = cfg.Limiter.Wrap(ctx, peer, rconn)
+				defer rconn.Close()
+			}
+
+			return forwardCopy(msg.Network, rconn, lconn)
 		},
 	}
 }
@@ -1,16 +1,24 @@
 package tuntunfwd
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
-	"tuntuntun"
+	"time"
 	"tuntuntun/tuntunopener"
+	"tuntuntun/tuntunrate"
+	"tuntuntun/tuntuntls"
+
+	"golang.org/x/sync/errgroup"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,11 +41,11 @@ func TestServerOpenSanity(t *testing.T) {
 	ctx := t.Context()
 
 	cfg := Config{
-		LocalDial: func(ctx context.Context, addr string) (net.Conn, error) {
-			return net.Dial("tcp", addr)
+		LocalDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
 		},
-		LocalListen: func(ctx context.Context, addr string) (net.Listener, error) {
-			return net.Listen("tcp", addr)
+		LocalListen: func(ctx context.Context, network, addr string) (net.Listener, error) {
+			return net.Listen(network, addr)
 		},
 	}
 
@@ -58,35 +66,16 @@ func TestServerOpenSanity(t *testing.T) {
 		}), nil
 	})
 
-	l, err := net.Listen("tcp", ":0")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
-	defer l.Close()
 
 	go func() {
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
-
-				require.NoError(t, err)
-			}
-
-			go func() {
-				defer c.Close()
-
-				err := srv.ServeConn(ctx, c)
-				require.NoError(t, err)
-			}()
-		}
+		_ = tuntuntls.NewServer(srv, tuntuntls.WithServerPlaintext()).Serve(ctx, l)
 	}()
 
 	c := NewClient(
 		cfg,
-		tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
-			return net.Dial(l.Addr().Network(), l.Addr().String())
-		}),
+		tuntuntls.NewClient(l.Addr().String(), tuntuntls.WithPlaintext()),
 		DefaultPeerHandler(cfg, nil, func(ctx context.Context, raddr, laddr string) {
 			panic("should not be called")
 		}),
@@ -100,3 +89,279 @@ func TestServerOpenSanity(t *testing.T) {
 
 	assert.Equal(t, "hello", received)
 }
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		network string
+		addr    string
+	}{
+		{"localhost:5432", "tcp", "localhost:5432"},
+		{":5432", "tcp", ":5432"},
+		{"tcp4:127.0.0.1:5432", "tcp4", "127.0.0.1:5432"},
+		{"tcp6:[::1]:5432", "tcp6", "[::1]:5432"},
+		{"unix:/var/run/docker.sock", "unix", "/var/run/docker.sock"},
+		{"unix:@abstract", "unix", "@abstract"},
+		{"unixpacket:/tmp/sock", "unixpacket", "/tmp/sock"},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			network, addr, err := ParseAddr(tc.s)
+			require.NoError(t, err)
+			assert.Equal(t, tc.network, network)
+			assert.Equal(t, tc.addr, addr)
+		})
+	}
+
+	for _, s := range []string{"udp:localhost:53", "unixgram:/tmp/sock", "ip4:127.0.0.1"} {
+		t.Run(s, func(t *testing.T) {
+			_, _, err := ParseAddr(s)
+			require.ErrorContains(t, err, "unsupported network")
+		})
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		f forward
+	}{
+		{"localhost:5432", forward{"tcp", ":0", "tcp", "localhost:5432"}},
+		{"127.0.0.1:15432=localhost:5432", forward{"tcp", "127.0.0.1:15432", "tcp", "localhost:5432"}},
+		{"unix:/tmp/docker.sock=unix:/var/run/docker.sock", forward{"unix", "/tmp/docker.sock", "unix", "/var/run/docker.sock"}},
+		{"unixpacket:/tmp/a=unixpacket:/tmp/b", forward{"unixpacket", "/tmp/a", "unixpacket", "/tmp/b"}},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			f, err := parseForward(tc.s)
+			require.NoError(t, err)
+			assert.Equal(t, tc.f, f)
+		})
+	}
+
+	t.Run("unsupported network", func(t *testing.T) {
+		_, err := parseForward("udp::53=localhost:53")
+		require.ErrorContains(t, err, "unsupported network")
+	})
+}
+
+func TestInit(t *testing.T) {
+	t.Run("network", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteInit(&buf, "unix", "/var/run/docker.sock"))
+
+		msg, err := ReadInit(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, Message{Version: V1, Network: "unix", Addr: "/var/run/docker.sock"}, msg)
+	})
+
+	t.Run("default network", func(t *testing.T) {
+		msg, err := ReadInit(strings.NewReader(`{"version":1,"addr":"localhost:5432"}`))
+		require.NoError(t, err)
+		assert.Equal(t, "tcp", msg.Network)
+	})
+
+	t.Run("unsupported network", func(t *testing.T) {
+		_, err := ReadInit(strings.NewReader(`{"version":1,"network":"udp","addr":"localhost:53"}`))
+		require.ErrorContains(t, err, "unsupported network")
+	})
+}
+
+func TestDialUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.sock")
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	cfg := Config{
+		LocalDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+
+	rconn, lconn := net.Pipe()
+	defer rconn.Close()
+
+	go func() {
+		_ = DefaultPeerHandler(cfg, nil, nil).ServeConn(t.Context(), lconn)
+	}()
+
+	network, addr, err := ParseAddr("unix:" + path)
+	require.NoError(t, err)
+	require.NoError(t, WriteInit(rconn, network, addr))
+
+	_, err = rconn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(rconn), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestDialUnixPacket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.sock")
+
+	l, err := net.Listen("unixpacket", path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	// replies to every packet with its size
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+
+			_, err = conn.Write([]byte(strconv.Itoa(n)))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	cfg := Config{
+		LocalDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+
+	rconn, lconn := net.Pipe()
+	defer rconn.Close()
+
+	go func() {
+		_ = DefaultPeerHandler(cfg, nil, nil).ServeConn(t.Context(), lconn)
+	}()
+
+	require.NoError(t, WriteInit(rconn, "unixpacket", path))
+
+	pconn := &packetConn{ReadWriteCloser: rconn}
+	buf := make([]byte, MaxPacketSize)
+	for _, size := range []int{1, 100, 40_000} {
+		_, err := pconn.Write(make([]byte, size))
+		require.NoError(t, err)
+
+		n, err := pconn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(size), string(buf[:n]))
+	}
+}
+
+// sender serves 5_000 bytes to every conn.
+func sender(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = conn.Write(make([]byte, 5_000))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestLimiterPerPeer(t *testing.T) {
+	forward := func(t *testing.T, h tuntunopener.PeerHandler, addr string) error {
+		rconn, lconn := net.Pipe()
+		defer rconn.Close()
+
+		go func() {
+			_ = h.ServeConn(t.Context(), lconn)
+		}()
+
+		err := WriteInit(rconn, "tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		b, err := io.ReadAll(rconn)
+		if err != nil {
+			return err
+		}
+		if len(b) != 5_000 {
+			return fmt.Errorf("read %v bytes", len(b))
+		}
+
+		return nil
+	}
+
+	newConfig := func() Config {
+		return Config{
+			LocalDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+			// 10_000 bytes/s with a 1_000 bytes burst, each forward takes 400ms
+			Limiter: tuntunrate.NewLimiter(tuntunrate.WithPerPeer(0, 10_000), tuntunrate.WithBurst(1_000)),
+		}
+	}
+
+	t.Run("peers to the same address", func(t *testing.T) {
+		cfg := newConfig()
+		addr := sender(t)
+
+		start := time.Now()
+
+		var g errgroup.Group
+		for range 2 {
+			h := DefaultPeerHandler(cfg, nil, nil)
+			g.Go(func() error {
+				return forward(t, h, addr)
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		assert.Less(t, time.Since(start), 800*time.Millisecond)
+	})
+
+	t.Run("peer to different addresses", func(t *testing.T) {
+		cfg := newConfig()
+		h := DefaultPeerHandler(cfg, nil, nil)
+
+		start := time.Now()
+
+		var g errgroup.Group
+		for range 2 {
+			addr := sender(t)
+			g.Go(func() error {
+				return forward(t, h, addr)
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		assert.GreaterOrEqual(t, time.Since(start), 800*time.Millisecond)
+	})
+}
@@ -0,0 +1,149 @@
+package tuntunh1
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"tuntuntun/internal/pipeconn"
+)
+
+type ClientOption func(c *Client)
+
+// WithHTTPClient sets the client used to send the requests, it must not time
+// out requests since they last as long as the conn.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.Client = hc
+	}
+}
+
+func NewClient(url string, opts ...ClientOption) *Client {
+	c := &Client{
+		url:    url,
+		Client: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type Client struct {
+	Client *http.Client
+	url    string
+}
+
+func (c *Client) requestURL(id, dir string) (string, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set(sessionParam, id)
+	q.Set(directionParam, dir)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Connect sends the down request, then the up one once the server answered.
+func (c *Client) Connect(ctx context.Context) (net.Conn, *http.Response, error) {
+	id := rand.Text()
+
+	downURL, err := c.requestURL(id, directionDown)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upURL, err := c.requestURL(id, directionUp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the requests outlive ctx, which only bounds the establishment of the conn
+	connCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	var laddr, raddr net.Addr
+	traceCtx := httptrace.WithClientTrace(connCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			laddr = info.Conn.LocalAddr()
+			raddr = info.Conn.RemoteAddr()
+		},
+	})
+
+	req, err := http.NewRequestWithContext(traceCtx, http.MethodGet, downURL, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("h1: unexpected status %v", resp.Status)
+	}
+
+	pw, pr := pipeconn.NewBodyPipe()
+
+	upReq, err := http.NewRequestWithContext(connCtx, http.MethodPost, upURL, pr)
+	if err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, nil, err
+	}
+	upReq.Header.Set("Content-Type", "application/octet-stream")
+
+	go func() {
+		upResp, err := c.Client.Do(upReq)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer upResp.Body.Close()
+
+		if upResp.StatusCode != http.StatusOK {
+			pw.CloseWithError(fmt.Errorf("h1: unexpected status %v", upResp.Status))
+			return
+		}
+
+		// the server is done reading
+		pw.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	body := pipeconn.NewPipeReader(resp.Body)
+
+	conn := newConn(body, pw, func() error {
+		err := body.Close()
+		cancel()
+
+		return err
+	})
+	conn.deadlines = splitDeadlines{read: body, write: pw}
+	if laddr != nil {
+		conn.laddr = laddr
+		conn.raddr = raddr
+	}
+
+	return conn, resp, nil
+}
+
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	conn, _, err := c.Connect(ctx)
+
+	return conn, err
+}
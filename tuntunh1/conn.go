@@ -0,0 +1,105 @@
+package tuntunh1
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+type h1Addr struct {
+}
+
+func (a h1Addr) Network() string {
+	return "h1"
+}
+
+func (a h1Addr) String() string {
+	return "h1/unknown-addr"
+}
+
+type deadliner interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+// splitDeadlines sets the read deadline on read and the write one on write.
+type splitDeadlines struct {
+	read  deadliner
+	write deadliner
+}
+
+func (d splitDeadlines) SetReadDeadline(t time.Time) error {
+	return d.read.SetReadDeadline(t)
+}
+
+func (d splitDeadlines) SetWriteDeadline(t time.Time) error {
+	return d.write.SetWriteDeadline(t)
+}
+
+// Conn reads from one request and writes to the other.
+type Conn struct {
+	r         io.Reader
+	w         io.WriteCloser
+	closeRead func() error
+
+	laddr     net.Addr
+	raddr     net.Addr
+	deadlines deadliner
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(r io.Reader, w io.WriteCloser, closeRead func() error) *Conn {
+	return &Conn{
+		r:         r,
+		w:         w,
+		closeRead: closeRead,
+		laddr:     h1Addr{},
+		raddr:     h1Addr{},
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	err1 := c.SetReadDeadline(t)
+	err2 := c.SetWriteDeadline(t)
+
+	return errors.Join(err1, err2)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.deadlines.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.deadlines.SetWriteDeadline(t)
+}
+
+func (c *Conn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+func (c *Conn) Write(data []byte) (int, error) {
+	return c.w.Write(data)
+}
+
+// CloseWrite ends the request carrying the written data, the peer can keep on
+// writing.
+func (c *Conn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *Conn) Close() error {
+	err1 := c.w.Close()
+	err2 := c.closeRead()
+
+	return errors.Join(err1, err2)
+}
@@ -0,0 +1,303 @@
+package tuntunh1
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"tuntuntun"
+	"tuntuntun/internal/httpconn"
+)
+
+// A conn is carried by two long-lived requests sharing a session ID: a GET whose
+// streamed response carries the server to client data, and a POST whose chunked
+// body carries the client to server data.
+const (
+	sessionParam   = "session"
+	directionParam = "dir"
+	directionDown  = "down"
+	directionUp    = "up"
+)
+
+// IsRequest reports whether r is one of the requests carrying a conn, so that
+// the server can share a url with other transports.
+func IsRequest(r *http.Request) bool {
+	q := r.URL.Query()
+
+	return q.Has(sessionParam) && q.Has(directionParam)
+}
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithPairTimeout sets how long a request waits for the other request of its
+// conn, 30s by default.
+func WithPairTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.pairTimeout = d
+	}
+}
+
+type Server struct {
+	handler     tuntuntun.Handler
+	logger      *slog.Logger
+	pairTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pair
+}
+
+// pair is a conn waiting for both of its requests.
+type pair struct {
+	ready chan struct{}
+	down  *downWriter
+	up    *http.Request
+}
+
+func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
+	s := &Server{
+		handler:     handler,
+		pairTimeout: 30 * time.Second,
+		pending:     map[string]*pair{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get(sessionParam)
+	if id == "" {
+		http.Error(w, "missing session", http.StatusBadRequest)
+		return
+	}
+
+	switch dir := r.URL.Query().Get(directionParam); {
+	case r.Method == http.MethodGet && dir == directionDown:
+		s.serveDown(w, r, id)
+	case r.Method == http.MethodPost && dir == directionUp:
+		s.serveUp(w, r, id)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// join registers a request of the conn id, set returns false when the request
+// was already registered.
+func (s *Server) join(id string, set func(p *pair) bool) (*pair, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[id]
+	if !ok {
+		p = &pair{ready: make(chan struct{})}
+		s.pending[id] = p
+	}
+
+	if !set(p) {
+		return nil, false
+	}
+
+	if p.down != nil && p.up != nil {
+		delete(s.pending, id)
+		close(p.ready)
+	}
+
+	return p, true
+}
+
+// wait waits for the other request of the conn, up to the pair timeout.
+func (s *Server) wait(ctx context.Context, id string, p *pair) bool {
+	t := time.NewTimer(s.pairTimeout)
+	defer t.Stop()
+
+	select {
+	case <-p.ready:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	if s.pending[id] == p {
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+
+	// the other request may have joined in the meantime
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) serveDown(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "unsupported writer", http.StatusBadRequest)
+		return
+	}
+
+	dw := newDownWriter(r.Context(), w, flusher)
+	defer dw.Close()
+
+	p, ok := s.join(id, func(p *pair) bool {
+		if p.down != nil {
+			return false
+		}
+		p.down = dw
+		return true
+	})
+	if !ok {
+		http.Error(w, "duplicate request", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// asks buffering proxies such as nginx to stream the response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if !s.wait(r.Context(), id, p) {
+		return
+	}
+
+	select {
+	case <-dw.done:
+	case <-r.Context().Done():
+	}
+
+	if dw.aborted() {
+		// cuts the response short, so that the client does not mistake it for
+		// a clean end of stream
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) serveUp(w http.ResponseWriter, r *http.Request, id string) {
+	p, ok := s.join(id, func(p *pair) bool {
+		if p.up != nil {
+			return false
+		}
+		p.up = r
+		return true
+	})
+	if !ok {
+		http.Error(w, "duplicate request", http.StatusConflict)
+		return
+	}
+
+	if !s.wait(r.Context(), id, p) {
+		http.Error(w, "no matching down request", http.StatusGatewayTimeout)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// the conn is gone as soon as either request is
+	stop := context.AfterFunc(p.down.ctx, cancel)
+	defer stop()
+
+	upRC := http.NewResponseController(w)
+
+	conn := newConn(r.Body, p.down, func() error {
+		// a pending read holds the body lock, expiring the deadline unblocks it
+		return upRC.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer conn.Close()
+
+	conn.raddr = httpconn.ParseAddr(r.RemoteAddr, h1Addr{})
+	if laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.laddr = laddr
+	}
+	conn.deadlines = splitDeadlines{read: upRC, write: p.down.rc}
+
+	err := s.handler.ServeConn(ctx, conn)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelError, "h1: failed to serve", slog.String("err", err.Error()))
+		}
+
+		p.down.abort()
+	}
+}
+
+// downWriter writes to the response of the down request, flushing every write.
+type downWriter struct {
+	ctx context.Context
+	w   http.ResponseWriter
+	f   http.Flusher
+	rc  *http.ResponseController
+
+	mu        sync.Mutex
+	closed    bool
+	isAborted bool
+	done      chan struct{}
+}
+
+func newDownWriter(ctx context.Context, w http.ResponseWriter, f http.Flusher) *downWriter {
+	return &downWriter{
+		ctx:  ctx,
+		w:    w,
+		f:    f,
+		rc:   http.NewResponseController(w),
+		done: make(chan struct{}),
+	}
+}
+
+func (w *downWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := w.w.Write(p)
+	w.f.Flush()
+
+	return n, err
+}
+
+// Close ends the down response, the up request can still be read.
+func (w *downWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+	}
+
+	return nil
+}
+
+func (w *downWriter) abort() {
+	w.mu.Lock()
+	w.isAborted = true
+	w.mu.Unlock()
+
+	_ = w.Close()
+}
+
+func (w *downWriter) aborted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.isAborted
+}
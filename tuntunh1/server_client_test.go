@@ -0,0 +1,205 @@
+package tuntunh1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+	"tuntuntun"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(t *testing.T, expected string) tuntuntun.HandlerFunc {
+	return func(ctx context.Context, conn io.ReadWriteCloser) error {
+		defer conn.Close()
+
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("said: " + string(buf)))
+
+		return err
+	}
+}
+
+func roundtrip(t *testing.T, conn net.Conn, sent string) {
+	expected := "said: " + sent
+
+	go func() {
+		_, _ = conn.Write([]byte(sent))
+	}()
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, string(buf))
+}
+
+// proxied serves h behind a reverse proxy, as found in the networks this
+// transport is meant for.
+func proxied(t *testing.T, h http.Handler) string {
+	backend := httptest.NewServer(h)
+	t.Cleanup(backend.Close)
+
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(u))
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+func TestSanity(t *testing.T) {
+	toWrite := "hello"
+
+	c := NewClient(proxied(t, NewServer(echo(t, toWrite))))
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, toWrite)
+}
+
+func TestStress(t *testing.T) {
+	toWrite := "hello"
+
+	c := NewClient(proxied(t, NewServer(echo(t, toWrite))))
+
+	var g errgroup.Group
+	for range 100 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, toWrite)
+
+			return nil
+		})
+	}
+
+	require.NoError(t, g.Wait())
+}
+
+func TestHalfClose(t *testing.T) {
+	h := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := conn.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+
+		// the down response ends while the up request is still read
+		err = conn.(*Conn).CloseWrite()
+		if err != nil {
+			return err
+		}
+
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+
+		_ = conn.Close()
+
+		if string(b) != "world" {
+			return fmt.Errorf("unexpected body %q", b)
+		}
+
+		return nil
+	}))
+
+	conn, err := NewClient(proxied(t, h)).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	_, err = conn.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*Conn).CloseWrite())
+}
+
+func TestServerAbort(t *testing.T) {
+	h := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := conn.Write([]byte("partial"))
+		if err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.ReadAll(conn)
+	require.Error(t, err)
+}
+
+func TestPairTimeout(t *testing.T) {
+	srv := httptest.NewServer(NewServer(echo(t, "hello"), WithPairTimeout(50*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	// a down request alone ends once the pair timeout passes
+	res, err := http.Get(srv.URL + "?session=lonely&dir=down")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Empty(t, b)
+
+	res, err = http.Post(srv.URL+"?session=lonely&dir=up", "application/octet-stream", nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+}
+
+func TestClientDeadlines(t *testing.T) {
+	toWrite := "hello"
+
+	srv := httptest.NewServer(NewServer(echo(t, toWrite)))
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the server stays silent until it gets the message
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the passed deadline can be extended, and left writes alone
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	roundtrip(t, conn, toWrite)
+}
@@ -3,45 +3,171 @@ package tuntunh2
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"tuntuntun/internal/pipeconn"
 
 	"golang.org/x/net/http2"
 )
 
-func NewClient(url string) *Client {
-	return &Client{
+type ClientOption func(c *Client)
+
+// WithTLSConfig sets the TLS configuration used to reach the server, it is
+// cloned and completed with the h2 ALPN protocol. WithRootCAs, WithServerName
+// and WithClientCertificate apply on top of it, whatever the order of the
+// options.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithRootCAs sets the certificate authorities the server certificate is
+// verified against, the system ones are used by default.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate adds a certificate presented to servers requiring
+// client authentication.
+func WithClientCertificate(cert tls.Certificate) ClientOption {
+	return func(c *Client) {
+		c.certificates = append(c.certificates, cert)
+	}
+}
+
+// WithServerName overrides the name the server certificate is verified against,
+// which defaults to the host of the url.
+func WithServerName(name string) ClientOption {
+	return func(c *Client) {
+		c.serverName = name
+	}
+}
+
+// WithH2C makes the client speak cleartext HTTP/2 without TLS, whatever the
+// scheme of the url.
+func WithH2C() ClientOption {
+	return func(c *Client) {
+		c.h2c = true
+	}
+}
+
+// NewClient returns a client opening conns to the server at url, over TLS unless
+// WithH2C is set.
+func NewClient(url string, opts ...ClientOption) *Client {
+	c := &Client{
 		url: url,
-		Client: &http.Client{Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return net.Dial(network, addr)
-			},
-		}},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	t := &http2.Transport{}
+	if c.h2c {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	} else {
+		cfg := c.tls()
+		if !slices.Contains(cfg.NextProtos, http2.NextProtoTLS) {
+			cfg.NextProtos = append(cfg.NextProtos, http2.NextProtoTLS)
+		}
+		t.TLSClientConfig = cfg
+	}
+
+	c.Client = &http.Client{Transport: t}
+
+	return c
 }
 
 type Client struct {
-	// Client must have an http2.Transport as its transport.
-	Client *http.Client
-	url    string
+	// Client must have an HTTP/2 transport, e.g. an http2.Transport or an
+	// http2.ClientConn.
+	Client       *http.Client
+	url          string
+	tlsConfig    *tls.Config
+	rootCAs      *x509.CertPool
+	certificates []tls.Certificate
+	serverName   string
+	h2c          bool
 }
 
+// tls returns the TLS configuration given with WithTLSConfig, completed with
+// the other TLS options.
+func (c *Client) tls() *tls.Config {
+	cfg := c.tlsConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if c.rootCAs != nil {
+		cfg.RootCAs = c.rootCAs
+	}
+	if c.serverName != "" {
+		cfg.ServerName = c.serverName
+	}
+	cfg.Certificates = append(cfg.Certificates, c.certificates...)
+
+	return cfg
+}
+
+// Connect opens a conn living as long as ctx. When the server rejects it, its
+// response is returned along with the error.
 func (c *Client) Connect(ctx context.Context) (net.Conn, *http.Response, error) {
-	reader, writer := io.Pipe()
+	// the request is cancelled once the conn is closed
+	ctx, cancel := context.WithCancel(ctx)
+
+	var laddr, raddr net.Addr
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			laddr = info.Conn.LocalAddr()
+			raddr = info.Conn.RemoteAddr()
+		},
+	})
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, reader)
+	writer, body := pipeconn.NewBodyPipe()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, body)
 	if err != nil {
+		cancel()
 		return nil, nil, err
 	}
+	req.Header.Set(framingHeader, framingV1)
 
 	resp, err := c.Client.Do(req)
 	if err != nil {
+		cancel()
 		return nil, nil, err
 	}
 
-	conn := newConn(resp.Body, writer)
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		_ = writer.Close()
+		cancel()
+		// resp holds the rejection
+		return nil, resp, fmt.Errorf("h2: unexpected status %v", resp.Status)
+	}
+
+	var respBody io.ReadCloser = resp.Body
+	if resp.Header.Get(framingHeader) == framingV1 {
+		respBody = newFrameReader(resp.Body)
+	}
+
+	conn := newConn(pipeconn.NewPipeReader(respBody), writer)
+	conn.onClose = cancel
+	if laddr != nil {
+		conn.laddr = laddr
+		conn.raddr = raddr
+	}
 
 	return conn, resp, nil
 }
@@ -2,9 +2,9 @@ package tuntunh2
 
 import (
 	"errors"
-	"io"
 	"net"
 	"time"
+	"tuntuntun/internal/pipeconn"
 )
 
 type h2Addr struct {
@@ -18,35 +18,37 @@ func (a h2Addr) String() string {
 	return "h2/unknown-addr"
 }
 
+// Conn is a stream as a net.Conn, a deadline only interrupts the pending calls
+// in its direction and can be extended once passed.
 type Conn struct {
-	r io.ReadCloser
-	w io.WriteCloser
+	r *pipeconn.PipeReader
+	w *pipeconn.PipeWriter
+
+	laddr   net.Addr
+	raddr   net.Addr
+	onClose func()
 }
 
 var _ net.Conn = (*Conn)(nil)
 
-func newConn(r io.ReadCloser, wc io.WriteCloser) *Conn {
+func newConn(r *pipeconn.PipeReader, w *pipeconn.PipeWriter) *Conn {
 	return &Conn{
-		r: r,
-		w: wc,
+		r:     r,
+		w:     w,
+		laddr: h2Addr{},
+		raddr: h2Addr{},
 	}
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	return h2Addr{}
+	return c.laddr
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	return h2Addr{}
+	return c.raddr
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
-	if c, ok := c.w.(interface {
-		SetDeadline(deadline time.Time) error
-	}); ok {
-		return c.SetDeadline(t)
-	}
-
 	err1 := c.SetReadDeadline(t)
 	err2 := c.SetWriteDeadline(t)
 
@@ -54,23 +56,11 @@ func (c *Conn) SetDeadline(t time.Time) error {
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	if c, ok := c.w.(interface {
-		SetReadDeadline(deadline time.Time) error
-	}); ok {
-		return c.SetReadDeadline(t)
-	}
-
-	return nil
+	return c.r.SetReadDeadline(t)
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	if c, ok := c.w.(interface {
-		SetWriteDeadline(deadline time.Time) error
-	}); ok {
-		return c.SetWriteDeadline(t)
-	}
-
-	return nil
+	return c.w.SetWriteDeadline(t)
 }
 
 func (c *Conn) Write(data []byte) (int, error) {
@@ -81,9 +71,20 @@ func (c *Conn) Read(data []byte) (int, error) {
 	return c.r.Read(data)
 }
 
+// CloseWrite signals the end of the data written to the peer, which can keep
+// on writing. Servers can only half-close streams from clients negotiating
+// framing, and fully close them otherwise.
+func (c *Conn) CloseWrite() error {
+	return c.w.CloseWrite()
+}
+
 func (c *Conn) Close() error {
 	err1 := c.r.Close()
 	err2 := c.w.Close()
 
+	if c.onClose != nil {
+		c.onClose()
+	}
+
 	return errors.Join(err1, err2)
 }
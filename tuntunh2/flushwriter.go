@@ -2,27 +2,105 @@ package tuntunh2
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
 	"net/http"
+	"sync"
 )
 
 type responseWriterCloser struct {
 	http.ResponseWriter
 	f     http.Flusher
 	close context.CancelFunc
+	// framed is set when the client negotiated framing, see framingHeader.
+	framed bool
+
+	mu      sync.Mutex
+	closed  bool
+	wclosed bool
 }
 
 func (w *responseWriterCloser) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.wclosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if w.framed {
+		err := w.writeFrameHeader(len(data))
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	n, err := w.ResponseWriter.Write(data)
 	w.f.Flush()
 
 	return n, err
 }
 
+func (w *responseWriterCloser) writeFrameHeader(size int) error {
+	var hdr [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(size))
+
+	_, err := w.ResponseWriter.Write(hdr[:])
+
+	return err
+}
+
+// CloseWrite ends the response while the request body can still be read, it
+// requires framing and falls back to Close otherwise.
+func (w *responseWriterCloser) CloseWrite() error {
+	if !w.framed {
+		return w.Close()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closeWriteLocked()
+}
+
+func (w *responseWriterCloser) closeWriteLocked() error {
+	if w.closed || w.wclosed {
+		return nil
+	}
+	w.wclosed = true
+
+	err := w.writeFrameHeader(0)
+	w.f.Flush()
+
+	return err
+}
+
 func (w *responseWriterCloser) Close() error {
-	// Currently server side close of connection is not supported in Go.
-	// The server closes the connection when the http.Handler function returns.
-	// We use connection context and cancel function as a work-around.
+	w.mu.Lock()
+	var err error
+	if w.framed {
+		err = w.closeWriteLocked()
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	// The server closes the connection when the http.Handler function returns,
+	// cancelling the context lets the handler return.
 	w.close()
 
-	return nil
+	return err
+}
+
+// abort prevents further writes without ending the response cleanly, the
+// ResponseWriter must not be used once the handler returned.
+func (w *responseWriterCloser) abort() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	w.close()
 }
@@ -0,0 +1,71 @@
+package tuntunh2
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// A server cannot end its response while still reading the request body, the
+// response is the end of the handler. When the client sends framingHeader, and
+// the server echoes it back, the response body is made of frames prefixed with
+// their length, a zero length frame ending the stream.
+const (
+	framingHeader   = "Tuntun-Framing"
+	framingV1       = "1"
+	frameHeaderSize = 4
+)
+
+// frameReader reads a framed response body.
+type frameReader struct {
+	r         io.ReadCloser
+	hdr       [frameHeaderSize]byte
+	remaining uint32
+	eof       bool
+}
+
+func newFrameReader(r io.ReadCloser) *frameReader {
+	return &frameReader{r: r}
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+
+	for r.remaining == 0 {
+		_, err := io.ReadFull(r.r, r.hdr[:])
+		if err != nil {
+			if err == io.EOF {
+				// the response ended without an end of stream frame
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		r.remaining = binary.BigEndian.Uint32(r.hdr[:])
+		if r.remaining == 0 {
+			r.eof = true
+			return 0, io.EOF
+		}
+	}
+
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= uint32(n)
+
+	if err == io.EOF {
+		if r.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *frameReader) Close() error {
+	return r.r.Close()
+}
@@ -3,8 +3,11 @@ package tuntunh2
 import (
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"tuntuntun"
+	"tuntuntun/internal/httpconn"
+	"tuntuntun/internal/pipeconn"
 )
 
 type Option func(s *Server)
@@ -46,9 +49,24 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	conn := newConn(r.Body, &responseWriterCloser{ResponseWriter: w, close: cancel, f: flusher})
-	defer conn.Close()
+	rw := &responseWriterCloser{
+		ResponseWriter: w,
+		close:          cancel,
+		f:              flusher,
+		framed:         r.Header.Get(framingHeader) == framingV1,
+	}
+	defer rw.abort()
+
+	conn := newConn(pipeconn.NewPipeReader(r.Body), pipeconn.NewPipeWriter(rw))
 
+	conn.raddr = httpconn.ParseAddr(r.RemoteAddr, h2Addr{})
+	if laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.laddr = laddr
+	}
+
+	if rw.framed {
+		w.Header().Set(framingHeader, framingV1)
+	}
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
@@ -57,6 +75,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if s.logger != nil {
 			s.logger.Log(ctx, slog.LevelError, "h2: failed to serve", slog.String("err", err.Error()))
 		}
-		return
+
+		// the pumps must be done with the stream before the handler returns
+		_ = conn.r.Close()
+		conn.w.Flush()
+
+		// resets the stream, so that the client does not mistake it for a
+		// clean end of stream
+		panic(http.ErrAbortHandler)
 	}
+
+	_ = conn.Close()
 }
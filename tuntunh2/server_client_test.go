@@ -2,12 +2,17 @@ package tuntunh2
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 	"tuntuntun"
 
 	"golang.org/x/net/http2"
@@ -74,7 +79,7 @@ func TestSanity(t *testing.T) {
 
 	t.Log("URL", srv.URL)
 
-	c := NewClient(srv.URL)
+	c := NewClient(srv.URL, WithH2C())
 
 	conn, _, err := c.Connect(t.Context())
 	require.NoError(t, err)
@@ -99,7 +104,7 @@ func TestSanityLarge(t *testing.T) {
 
 	t.Log("URL", srv.URL)
 
-	c := NewClient(srv.URL)
+	c := NewClient(srv.URL, WithH2C())
 
 	conn, _, err := c.Connect(t.Context())
 	require.NoError(t, err)
@@ -119,7 +124,7 @@ func TestStress(t *testing.T) {
 	var g errgroup.Group
 	for range 1000 {
 		g.Go(func() error {
-			c := NewClient(srv.URL)
+			c := NewClient(srv.URL, WithH2C())
 
 			conn, _, err := c.Connect(t.Context())
 			require.NoError(t, err)
@@ -133,3 +138,357 @@ func TestStress(t *testing.T) {
 
 	g.Wait()
 }
+
+func newTLSServer(t *testing.T, h http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestTLS(t *testing.T) {
+	toWrite := "hello"
+
+	srv := newTLSServer(t, NewServer(echo(t, toWrite)))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	t.Run("root ca", func(t *testing.T) {
+		c := NewClient(srv.URL, WithRootCAs(pool))
+
+		conn, res, err := c.Connect(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NotNil(t, res.TLS)
+		assert.Equal(t, http2.NextProtoTLS, res.TLS.NegotiatedProtocol)
+
+		roundtrip(t, conn, toWrite)
+	})
+
+	t.Run("server name", func(t *testing.T) {
+		// the test certificate is valid for example.com
+		c := NewClient(srv.URL, WithRootCAs(pool), WithServerName("example.com"))
+
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		roundtrip(t, conn, toWrite)
+
+		c = NewClient(srv.URL, WithRootCAs(pool), WithServerName("other.test"))
+
+		_, err = c.Open(t.Context())
+		require.Error(t, err)
+	})
+
+	t.Run("tls config", func(t *testing.T) {
+		cfg := &tls.Config{ServerName: "other.test"}
+
+		// the other options apply on top of the config, in any order
+		for _, opts := range [][]ClientOption{
+			{WithTLSConfig(cfg), WithRootCAs(pool), WithServerName("example.com")},
+			{WithRootCAs(pool), WithServerName("example.com"), WithTLSConfig(cfg)},
+		} {
+			conn, err := NewClient(srv.URL, opts...).Open(t.Context())
+			require.NoError(t, err)
+
+			roundtrip(t, conn, toWrite)
+			conn.Close()
+		}
+
+		assert.Equal(t, "other.test", cfg.ServerName)
+		assert.Empty(t, cfg.NextProtos)
+	})
+
+	t.Run("unknown authority", func(t *testing.T) {
+		c := NewClient(srv.URL)
+
+		_, err := c.Open(t.Context())
+		require.Error(t, err)
+	})
+
+	t.Run("h2c to tls", func(t *testing.T) {
+		c := NewClient(srv.URL, WithH2C())
+
+		_, err := c.Open(t.Context())
+		require.Error(t, err)
+	})
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	toWrite := "hello"
+
+	var peerCerts []*x509.Certificate
+	h := NewServer(echo(t, toWrite))
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCerts = r.TLS.PeerCertificates
+		h.ServeHTTP(w, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	_, err := NewClient(srv.URL, WithRootCAs(pool)).Open(t.Context())
+	require.Error(t, err)
+
+	// reuse the server certificate as the client one
+	c := NewClient(srv.URL, WithRootCAs(pool), WithClientCertificate(srv.TLS.Certificates[0]))
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, toWrite)
+
+	require.Len(t, peerCerts, 1)
+	assert.Equal(t, srv.Certificate().Raw, peerCerts[0].Raw)
+}
+
+func TestAddrs(t *testing.T) {
+	addrs := make(chan [2]net.Addr, 1)
+
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		c := conn.(net.Conn)
+		addrs <- [2]net.Addr{c.LocalAddr(), c.RemoteAddr()}
+
+		_, err := conn.Write([]byte("ok"))
+		return err
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	serverAddrs := <-addrs
+
+	assert.Equal(t, srv.Listener.Addr().String(), conn.RemoteAddr().String())
+	assert.Equal(t, srv.Listener.Addr().String(), serverAddrs[0].String())
+	assert.Equal(t, conn.LocalAddr().String(), serverAddrs[1].String())
+}
+
+func TestDeadlines(t *testing.T) {
+	serverErr := make(chan error, 2)
+
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		c := conn.(net.Conn)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+		_, err := c.Read(make([]byte, 1))
+		serverErr <- err
+
+		// the stream outlives the deadline once it is extended
+		require.NoError(t, c.SetReadDeadline(time.Time{}))
+
+		_, err = io.Copy(conn, conn)
+		return err
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the server deadline passes while the client stays silent
+	require.ErrorIs(t, <-serverErr, os.ErrDeadlineExceeded)
+
+	echoed := func(msg string) {
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+
+	echoed("hello")
+
+	// extending the deadline before it passes keeps the stream alive
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Hour)))
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// a passed read deadline leaves writes alone, and can be extended
+	_, err = conn.Write([]byte("again"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(buf))
+
+	// a passed write deadline fails the pending write only
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write([]byte("late"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, conn.SetWriteDeadline(time.Time{}))
+	echoed("hello")
+}
+
+func TestHalfClose(t *testing.T) {
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := conn.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+
+		// the response ends while the request body is still read
+		err = conn.(*Conn).CloseWrite()
+		if err != nil {
+			return err
+		}
+
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+
+		if string(b) != "world" {
+			return fmt.Errorf("unexpected body %q", b)
+		}
+
+		return nil
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	_, err = conn.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*Conn).CloseWrite())
+}
+
+func TestServerClose(t *testing.T) {
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		read := make(chan error)
+		go func() {
+			_, err := io.ReadAll(conn)
+			read <- err
+		}()
+
+		_, err := conn.Write([]byte("bye"))
+		if err != nil {
+			return err
+		}
+
+		// closing unblocks the pending read and ends the stream
+		err = conn.Close()
+		if err != nil {
+			return err
+		}
+		<-read
+
+		return nil
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(b))
+}
+
+func TestServerAbort(t *testing.T) {
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := conn.Write([]byte("partial"))
+		if err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the stream is reset rather than ended
+	_, err = io.ReadAll(conn)
+	require.Error(t, err)
+}
+
+func TestBidiCopyHalfClose(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// answers once the request is over
+		b, _ := io.ReadAll(conn)
+		_, _ = fmt.Fprintf(conn, "got %d bytes", len(b))
+	}()
+
+	h := newServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		uconn, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			return err
+		}
+
+		return tuntuntun.BidiCopy(conn, uconn)
+	}))
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithH2C()).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(make([]byte, 100_000))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*Conn).CloseWrite())
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "got 100000 bytes", string(b))
+}
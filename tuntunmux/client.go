@@ -2,12 +2,28 @@ package tuntunmux
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 	"tuntuntun"
+)
+
+// Strategy decides which session of the pool a new stream is opened on.
+type Strategy int
 
-	"github.com/hashicorp/yamux"
+const (
+	// LeastStreams picks the session with the fewest active streams.
+	LeastStreams Strategy = iota
+	// RoundRobin cycles through the sessions.
+	RoundRobin
+)
+
+var (
+	ErrClientClosed  = errors.New("mux: client closed")
+	ErrSessionClosed = errors.New("mux: session closed")
 )
 
 type ClientOption func(s *Client)
@@ -18,86 +34,605 @@ func WithClientLogger(l *slog.Logger) ClientOption {
 	}
 }
 
+// WithClientSession tunes the yamux sessions opened by the client, when using
+// the default muxer.
+func WithClientSession(opts ...SessionOption) ClientOption {
+	return func(s *Client) {
+		s.sessionOpts = append(s.sessionOpts, opts...)
+	}
+}
+
+// WithClientMuxer sets the muxer used by the client, yamux by default. The
+// server must support it.
+func WithClientMuxer(m Muxer) ClientOption {
+	return func(s *Client) {
+		s.muxer = m
+	}
+}
+
+// WithClientPool lets the client stripe streams over up to size sessions, each on
+// its own underlying conn. A new session is only added once every existing one
+// is over the stream or bandwidth threshold.
+func WithClientPool(size int) ClientOption {
+	return func(s *Client) {
+		if size > 0 {
+			s.poolSize = size
+		}
+	}
+}
+
+// WithClientStrategy sets how streams are spread over the pool.
+func WithClientStrategy(strategy Strategy) ClientOption {
+	return func(s *Client) {
+		s.strategy = strategy
+	}
+}
+
+// WithClientStreamThreshold sets the number of active streams above which a
+// session is considered saturated.
+func WithClientStreamThreshold(n int) ClientOption {
+	return func(s *Client) {
+		s.streamThreshold = n
+	}
+}
+
+// WithClientBandwidthThreshold sets the throughput, in bytes per second, above
+// which a session is considered saturated.
+func WithClientBandwidthThreshold(bytesPerSecond int) ClientOption {
+	return func(s *Client) {
+		s.bandwidthThreshold = bytesPerSecond
+	}
+}
+
+// WithClientBackoff sets the delays between failed attempts at establishing a
+// session, doubling from min up to max.
+func WithClientBackoff(min, max time.Duration) ClientOption {
+	return func(s *Client) {
+		s.backoffMin = min
+		s.backoffMax = max
+	}
+}
+
+// WithClientStateHook registers a function called whenever the client goes up,
+// when its first session is established, or down, when its last session ends.
+// While down, it is also called with the error of every failed attempt at
+// establishing a session. Calls are serialized, the last one always reports the
+// current state.
+func WithClientStateHook(f func(state State, err error)) ClientOption {
+	return func(s *Client) {
+		s.stateHook = f
+	}
+}
+
+// WithClientHeaders makes every opened stream start with the Header attached to
+// the Open context with ContextWithHeader, or an empty one. The client announces
+// it when establishing a session, the server then reads the headers whether or
+// not it requires them with WithServerHeaders. Open also waits for the server to
+// accept the stream, and fails with ErrStreamRefused when it does not.
+func WithClientHeaders() ClientOption {
+	return func(s *Client) {
+		s.headers = true
+	}
+}
+
+// State is the connectivity of a Client.
+type State int
+
+const (
+	StateDown State = iota
+	StateUp
+)
+
+func (s State) String() string {
+	switch s {
+	case StateUp:
+		return "up"
+	default:
+		return "down"
+	}
+}
+
 func NewClient(opener tuntuntun.Opener, opts ...ClientOption) *Client {
 	s := &Client{
-		opener: opener,
+		opener:     opener,
+		poolSize:   1,
+		backoffMin: 100 * time.Millisecond,
+		backoffMax: 30 * time.Second,
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
 
+	if s.muxer == nil {
+		s.muxer = Yamux(s.sessionOpts...)
+	}
+
 	return s
 }
 
 type Client struct {
-	opener tuntuntun.Opener
-	logger *slog.Logger
+	opener             tuntuntun.Opener
+	logger             *slog.Logger
+	sessionOpts        []SessionOption
+	muxer              Muxer
+	poolSize           int
+	strategy           Strategy
+	streamThreshold    int
+	bandwidthThreshold int
+	backoffMin         time.Duration
+	backoffMax         time.Duration
+	stateHook          func(state State, err error)
+	headers            bool
+
+	mu       sync.Mutex
+	sessions []*session
+	draining []*session
+	next     int
+	state    State
+	stateErr error
+	gen      uint64
+	dial     *dialCall
+	failures int
+	retryAt  time.Time
+	// lost counts the sessions that ended and have not been replaced yet.
+	lost       int
+	reconnects uint64
+
+	// hookMu serializes the calls to the state hook, notified is the state it
+	// was last called with.
+	hookMu   sync.Mutex
+	notified State
+}
 
-	mu   sync.Mutex
-	sess *yamux.Session
+// dialCall is a session establishment in flight, shared by concurrent Opens.
+type dialCall struct {
+	done chan struct{}
+	sess *session
 	err  error
 }
 
-func (c *Client) getSession(ctx context.Context) (*yamux.Session, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *Client) saturated(s *session) bool {
+	if c.streamThreshold > 0 && s.NumStreams() >= c.streamThreshold {
+		return true
+	}
+
+	if c.bandwidthThreshold > 0 && s.bandwidth() >= float64(c.bandwidthThreshold) {
+		return true
+	}
+
+	return false
+}
+
+func (c *Client) pick() *session {
+	switch c.strategy {
+	case RoundRobin:
+		s := c.sessions[c.next%len(c.sessions)]
+		c.next++
+
+		return s
+	default:
+		var best *session
+		for _, s := range c.sessions {
+			if best == nil || s.NumStreams() < best.NumStreams() {
+				best = s
+			}
+		}
+
+		return best
+	}
+}
+
+// prune drops closed sessions and sets aside the ones draining after a GoAway,
+// must be called with the lock held.
+func (c *Client) prune() {
+	sessions := c.sessions[:0]
+	for _, s := range c.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		if s.goAway.Load() {
+			c.draining = append(c.draining, s)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	clear(c.sessions[len(sessions):])
+	c.sessions = sessions
+
+	draining := c.draining[:0]
+	for _, s := range c.draining {
+		if !s.IsClosed() {
+			draining = append(draining, s)
+		}
+	}
+	clear(c.draining[len(draining):])
+	c.draining = draining
+}
+
+// shouldGrow reports whether a new session is needed, must be called with the
+// lock held.
+func (c *Client) shouldGrow() bool {
+	if len(c.sessions) == 0 {
+		return true
+	}
+
+	if len(c.sessions) >= c.poolSize {
+		return false
+	}
+
+	for _, s := range c.sessions {
+		if !c.saturated(s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Client) backoff() time.Duration {
+	d := c.backoffMin
+	for i := 1; i < c.failures && d < c.backoffMax; i++ {
+		d *= 2
+	}
+
+	return min(d, c.backoffMax)
+}
+
+// setStateLocked records a transition, must be called with the lock held and
+// followed by notify once released.
+func (c *Client) setStateLocked(state State, err error) {
+	c.state = state
+	c.stateErr = err
+}
 
-	if c.err != nil {
-		return nil, c.err
+// notify calls the state hook with the current state when it changed since the
+// last call, or with the current error when failed is set and the client is
+// down. The state is read once the previous call returned, so that concurrent
+// transitions cannot leave the hook on a stale state.
+func (c *Client) notify(failed bool) {
+	if c.stateHook == nil {
+		return
 	}
 
-	if c.sess != nil && !c.sess.IsClosed() {
-		return c.sess, nil
+	c.hookMu.Lock()
+	defer c.hookMu.Unlock()
+
+	c.mu.Lock()
+	state, err := c.state, c.stateErr
+	c.mu.Unlock()
+
+	if state == c.notified && !(failed && state == StateDown) {
+		return
 	}
+	c.notified = state
+
+	c.stateHook(state, err)
+}
+
+// State returns whether the client currently has an established session.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *Client) getSession(ctx context.Context) (*session, error) {
+	for {
+		c.mu.Lock()
+		c.prune()
+
+		if !c.shouldGrow() {
+			s := c.pick()
+			c.mu.Unlock()
+
+			return s, nil
+		}
+
+		if d := c.dial; d != nil {
+			c.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-d.done:
+			}
+
+			if d.err == nil {
+				return d.sess, nil
+			}
+
+			if errors.Is(d.err, context.Canceled) || errors.Is(d.err, context.DeadlineExceeded) {
+				// the dialing Open gave up, try again with our own context
+				continue
+			}
+
+			c.mu.Lock()
+			c.prune()
+			if len(c.sessions) > 0 {
+				s := c.pick()
+				c.mu.Unlock()
+
+				return s, nil
+			}
+			c.mu.Unlock()
+
+			return nil, d.err
+		}
+
+		if wait := time.Until(c.retryAt); wait > 0 {
+			if len(c.sessions) > 0 {
+				// do not grow the pool until the backoff is over
+				s := c.pick()
+				c.mu.Unlock()
+
+				return s, nil
+			}
+			c.mu.Unlock()
+
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+
+			continue
+		}
+
+		d := &dialCall{done: make(chan struct{})}
+		c.dial = d
+		gen := c.gen
+		c.mu.Unlock()
+
+		d.sess, d.err = c.openSession(ctx)
+
+		var stale *session
+		c.mu.Lock()
+		c.dial = nil
+		switch {
+		case d.err != nil:
+			if ctx.Err() == nil {
+				c.failures++
+				c.retryAt = time.Now().Add(c.backoff())
+			}
+
+			c.prune()
+			if len(c.sessions) == 0 {
+				c.setStateLocked(StateDown, d.err)
+			}
+		case gen != c.gen:
+			// the client was closed while dialing
+			stale, d.sess = d.sess, nil
+			d.err = ErrClientClosed
+
+			c.prune()
+			if len(c.sessions) == 0 {
+				c.setStateLocked(StateDown, d.err)
+			}
+		default:
+			c.failures = 0
+			c.retryAt = time.Time{}
+			d.sess.gen = gen
+			c.sessions = append(c.sessions, d.sess)
+			if c.lost > 0 {
+				c.lost--
+				c.reconnects++
+			}
+			// set before watch may see the session end
+			c.setStateLocked(StateUp, nil)
+		}
+		c.mu.Unlock()
+		close(d.done)
+
+		if stale != nil {
+			_ = stale.Close()
+		}
+
+		if d.err != nil {
+			if c.logger != nil {
+				c.logger.Log(ctx, slog.LevelWarn, "mux: failed to open session", slog.String("err", d.err.Error()))
+			}
+
+			c.notify(true)
+
+			c.mu.Lock()
+			c.prune()
+			if len(c.sessions) > 0 {
+				s := c.pick()
+				c.mu.Unlock()
+
+				return s, nil
+			}
+			c.mu.Unlock()
+
+			return nil, d.err
+		}
 
-	if c.sess != nil {
-		_ = c.sess.Close()
+		go c.watch(d.sess)
+		c.notify(false)
+
+		return d.sess, nil
 	}
+}
+
+// watch removes the session from the pool once it ends, reporting the client
+// down when it was the last one.
+func (c *Client) watch(s *session) {
+	<-s.CloseChan()
 
-	c.sess, c.err = c.openSession(ctx)
+	c.mu.Lock()
+	if s.gen == c.gen {
+		c.lost++
+	}
+	c.prune()
+	if len(c.sessions) == 0 && c.dial == nil {
+		c.setStateLocked(StateDown, ErrSessionClosed)
+	}
+	c.mu.Unlock()
 
-	return c.sess, c.err
+	c.notify(false)
 }
 
-func (c *Client) openSession(ctx context.Context) (*yamux.Session, error) {
+func (c *Client) openSession(ctx context.Context) (*session, error) {
+	if v, ok := c.muxer.(verifier); ok {
+		err := v.verify()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	conn, err := c.opener.Open(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg := yamux.DefaultConfig()
-	cfg.Logger = logger{logger: c.logger, ctx: ctx}
-	cfg.LogOutput = nil
+	if c.headers {
+		err = writePreamble(conn, preambleHeaders|preambleStatus)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	cconn := newCountingConn(conn)
 
-	sess, err := yamux.Client(conn, cfg)
+	sess, err := c.muxer.Client(ctx, cconn, sessionLogger(c.logger, conn))
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
-	return sess, nil
+	return &session{Session: sess, conn: cconn, sched: newScheduler(), stats: newSessionStats()}, nil
 }
 
 func (c *Client) Open(ctx context.Context) (net.Conn, error) {
-	sess, err := c.getSession(ctx)
-	if err != nil {
-		return nil, err
+	for {
+		sess, err := c.getSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := sess.Open(ctx)
+		if errors.Is(err, ErrRemoteGoAway) {
+			// the server is draining this session, move on to another one
+			sess.goAway.Store(true)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sess.stats.streams.Add(1)
+
+		priority := PriorityFromContext(ctx)
+		conn = newScheduledConn(conn, sess.sched, priority)
+
+		if c.headers {
+			h := outgoingHeader(ctx)
+			if priority != PriorityDefault {
+				h = withPriorityHeader(h, priority)
+			}
+
+			err = WriteHeader(conn, h)
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+
+			// the server may be unable to answer
+			stop := context.AfterFunc(ctx, func() {
+				_ = conn.Close()
+			})
+			err = readStatus(conn)
+			if !stop() {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+
+		return conn, nil
 	}
+}
 
-	return sess.Open()
+// Stats returns a snapshot of the activity of the client and its sessions.
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ClientStats{
+		State:      c.state,
+		Reconnects: c.reconnects,
+	}
+	for _, s := range append(c.sessions[:len(c.sessions):len(c.sessions)], c.draining...) {
+		if s.IsClosed() {
+			continue
+		}
+
+		s.stats.startRTT(s)
+		stats.Sessions = append(stats.Sessions, s.stats.snapshot(s.NumStreams(), s.conn))
+	}
+
+	return stats
 }
 
+// Close closes every session, the client can be reused afterward.
 func (c *Client) Close() error {
-	if c.sess == nil {
-		return nil
+	c.mu.Lock()
+	sessions := append(c.sessions, c.draining...)
+	c.sessions = nil
+	c.draining = nil
+	c.gen++
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.lost = 0
+	c.mu.Unlock()
+
+	var errs []error
+	for _, s := range sessions {
+		errs = append(errs, s.Close())
 	}
 
-	defer func() {
-		c.mu.Lock()
-		defer c.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+type session struct {
+	Session
+	conn   *countingConn
+	sched  *scheduler
+	stats  *sessionStats
+	gen    uint64
+	goAway atomic.Bool
+
+	sampleAt    time.Time
+	sampleBytes uint64
+	rate        float64
+}
+
+// bandwidth returns the throughput of the session in bytes per second, sampled
+// at most once a second. Must be called with the client lock held.
+func (s *session) bandwidth() float64 {
+	now := time.Now()
+	total := s.conn.total()
+
+	if s.sampleAt.IsZero() {
+		s.sampleAt = now
+		s.sampleBytes = total
+		return 0
+	}
+
+	elapsed := now.Sub(s.sampleAt)
+	if elapsed < time.Second {
+		return s.rate
+	}
 
-		c.sess = nil
-		c.err = nil
-	}()
+	s.rate = float64(total-s.sampleBytes) / elapsed.Seconds()
+	s.sampleAt = now
+	s.sampleBytes = total
 
-	return c.sess.Close()
+	return s.rate
 }
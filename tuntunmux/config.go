@@ -0,0 +1,79 @@
+package tuntunmux
+
+import (
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// SessionOption tunes the yamux configuration of a session.
+type SessionOption func(cfg *yamux.Config)
+
+// WithWindowSize sets the maximum receive window of a stream, raise it for
+// high-latency links.
+func WithWindowSize(size uint32) SessionOption {
+	return func(cfg *yamux.Config) {
+		cfg.MaxStreamWindowSize = size
+	}
+}
+
+// WithAcceptBacklog sets how many streams may be waiting to be accepted before
+// new ones are reset.
+func WithAcceptBacklog(n int) SessionOption {
+	return func(cfg *yamux.Config) {
+		cfg.AcceptBacklog = n
+	}
+}
+
+// WithKeepAlive sets the keepalive ping interval, zero disables keepalive.
+func WithKeepAlive(interval time.Duration) SessionOption {
+	return func(cfg *yamux.Config) {
+		if interval <= 0 {
+			cfg.EnableKeepAlive = false
+			return
+		}
+
+		cfg.EnableKeepAlive = true
+		cfg.KeepAliveInterval = interval
+	}
+}
+
+// WithWriteTimeout sets how long a write to the underlying conn may block before
+// the session is considered dead.
+func WithWriteTimeout(d time.Duration) SessionOption {
+	return func(cfg *yamux.Config) {
+		cfg.ConnectionWriteTimeout = d
+	}
+}
+
+// WithStreamOpenTimeout sets how long an opened stream may wait for the peer's
+// ack, zero waits forever.
+func WithStreamOpenTimeout(d time.Duration) SessionOption {
+	return func(cfg *yamux.Config) {
+		cfg.StreamOpenTimeout = d
+	}
+}
+
+// WithStreamCloseTimeout sets how long a half-closed stream may linger before it
+// is reset.
+func WithStreamCloseTimeout(d time.Duration) SessionOption {
+	return func(cfg *yamux.Config) {
+		cfg.StreamCloseTimeout = d
+	}
+}
+
+func newConfig(opts []SessionOption) (*yamux.Config, error) {
+	cfg := yamux.DefaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	cfg.Logger = logger{}
+	cfg.LogOutput = nil
+
+	err := yamux.VerifyConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
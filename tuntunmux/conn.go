@@ -0,0 +1,143 @@
+package tuntunmux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingConn counts the bytes going through the underlying conn of a session.
+type countingConn struct {
+	net.Conn
+
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+func newCountingConn(conn net.Conn) *countingConn {
+	return &countingConn{Conn: conn}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+
+	return n, err
+}
+
+func (c *countingConn) total() uint64 {
+	return c.read.Load() + c.written.Load()
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string {
+	return "mux"
+}
+
+func (muxAddr) String() string {
+	return "mux/unknown-addr"
+}
+
+// rwcConn adapts an io.ReadWriteCloser to a net.Conn, forwarding addresses and
+// deadlines when the underlying value supports them.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func asNetConn(rwc io.ReadWriteCloser) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+
+	return rwcConn{rwc}
+}
+
+func (c rwcConn) LocalAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(interface{ LocalAddr() net.Addr }); ok {
+		return a.LocalAddr()
+	}
+
+	return muxAddr{}
+}
+
+func (c rwcConn) RemoteAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
+
+	return muxAddr{}
+}
+
+func (c rwcConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+
+	return nil
+}
+
+func (c rwcConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+
+	return nil
+}
+
+func (c rwcConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+
+	return nil
+}
+
+// notifyConn closes Done once the conn is closed or fails to read.
+type notifyConn struct {
+	net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newNotifyConn(conn net.Conn) *notifyConn {
+	return &notifyConn{Conn: conn, done: make(chan struct{})}
+}
+
+func (c *notifyConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *notifyConn) IsClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *notifyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+
+	return n, err
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+
+	return c.Conn.Close()
+}
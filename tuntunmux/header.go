@@ -0,0 +1,262 @@
+package tuntunmux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const headerV1 = 1
+
+// A client sending headers announces it with a preamble ahead of its session,
+// so that a server never mistakes headers for data or the other way around. The
+// preamble starts with a byte none of the muxers start with, servers predating
+// it fail to detect the muxer rather than misreading streams.
+const (
+	preambleMagic   = "TTMX"
+	preambleV1      = 1
+	preambleHeaders = 1 << 0
+	// preambleStatus asks the server to start every stream with a status,
+	// telling whether it accepted the stream.
+	preambleStatus = 1 << 1
+)
+
+// ErrStreamRefused is returned by Client.Open when the server refused the
+// stream, e.g. over its WithServerMaxStreams limit.
+var ErrStreamRefused = errors.New("mux: stream refused by the server")
+
+const (
+	statusAccepted = 0
+	statusRefused  = 1
+)
+
+// writeStatus answers a stream with its status, ahead of any data.
+func writeStatus(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{headerV1, status})
+
+	return err
+}
+
+// readStatus reads the status of a stream, it returns ErrStreamRefused when the
+// server refused it.
+func readStatus(r io.Reader) error {
+	b := make([]byte, 2)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return err
+	}
+
+	if b[0] != headerV1 {
+		return fmt.Errorf("unexpected status version: %d", b[0])
+	}
+
+	switch b[1] {
+	case statusAccepted:
+		return nil
+	case statusRefused:
+		return ErrStreamRefused
+	default:
+		return fmt.Errorf("unexpected stream status: %d", b[1])
+	}
+}
+
+func writePreamble(w io.Writer, flags byte) error {
+	_, err := w.Write(append([]byte(preambleMagic), preambleV1, flags))
+
+	return err
+}
+
+// readPreamble reads the preamble of a session if there is one, returning the
+// conn to read the session from and the flags of the preamble.
+func readPreamble(conn net.Conn) (net.Conn, byte, error) {
+	br := bufio.NewReader(conn)
+	conn = &prefixedConn{Conn: conn, r: br}
+
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if b[0] != preambleMagic[0] {
+		return conn, 0, nil
+	}
+
+	preamble := make([]byte, len(preambleMagic)+2)
+	_, err = io.ReadFull(br, preamble)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if string(preamble[:len(preambleMagic)]) != preambleMagic {
+		return nil, 0, errors.New("mux: malformed preamble")
+	}
+
+	if v := preamble[len(preambleMagic)]; v != preambleV1 {
+		return nil, 0, fmt.Errorf("mux: unexpected preamble version: %d", v)
+	}
+
+	return conn, preamble[len(preambleMagic)+1], nil
+}
+
+// MaxHeaderSize is the largest encoded Header a stream may carry.
+const MaxHeaderSize = 16 * 1024
+
+// Header is metadata sent ahead of the data of a stream, telling the server what
+// the stream is for.
+type Header struct {
+	// Type identifies the kind of stream, e.g. "fwd" or "rpc".
+	Type   string
+	Values map[string]string
+}
+
+func (h Header) Get(key string) string {
+	return h.Values[key]
+}
+
+type outgoingHeaderKey struct{}
+
+type incomingHeaderKey struct{}
+
+// ContextWithHeader attaches h to the streams opened with ctx by a Client with
+// headers enabled.
+func ContextWithHeader(ctx context.Context, h Header) context.Context {
+	return context.WithValue(ctx, outgoingHeaderKey{}, h)
+}
+
+func outgoingHeader(ctx context.Context) Header {
+	h, _ := ctx.Value(outgoingHeaderKey{}).(Header)
+
+	return h
+}
+
+func contextWithIncomingHeader(ctx context.Context, h Header) context.Context {
+	return context.WithValue(ctx, incomingHeaderKey{}, h)
+}
+
+// HeaderFromContext returns the header of the stream served with ctx by a
+// Server with headers enabled.
+func HeaderFromContext(ctx context.Context) (Header, bool) {
+	h, ok := ctx.Value(incomingHeaderKey{}).(Header)
+
+	return h, ok
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func WriteHeader(w io.Writer, h Header) error {
+	payload := appendString(nil, h.Type)
+	payload = binary.AppendUvarint(payload, uint64(len(h.Values)))
+	for k, v := range h.Values {
+		payload = appendString(payload, k)
+		payload = appendString(payload, v)
+	}
+
+	if len(payload) > MaxHeaderSize {
+		return fmt.Errorf("header too large: %d bytes", len(payload))
+	}
+
+	b := make([]byte, 3, 3+len(payload))
+	b[0] = headerV1
+	binary.LittleEndian.PutUint16(b[1:3], uint16(len(payload)))
+	b = append(b, payload...)
+
+	_, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type headerReader struct {
+	b []byte
+}
+
+func (r *headerReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errors.New("malformed header")
+	}
+	r.b = r.b[n:]
+
+	return v, nil
+}
+
+func (r *headerReader) string() (string, error) {
+	l, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+
+	if l > uint64(len(r.b)) {
+		return "", errors.New("malformed header")
+	}
+
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+
+	return s, nil
+}
+
+func ReadHeader(rd io.Reader) (Header, error) {
+	var h Header
+
+	prefix := make([]byte, 3)
+	_, err := io.ReadFull(rd, prefix)
+	if err != nil {
+		return h, err
+	}
+
+	if prefix[0] != headerV1 {
+		return h, fmt.Errorf("unexpected header version: %d", prefix[0])
+	}
+
+	size := binary.LittleEndian.Uint16(prefix[1:3])
+	if size > MaxHeaderSize {
+		return h, fmt.Errorf("header too large: %d bytes", size)
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(rd, b)
+	if err != nil {
+		return h, err
+	}
+
+	r := &headerReader{b: b}
+
+	h.Type, err = r.string()
+	if err != nil {
+		return h, err
+	}
+
+	count, err := r.uvarint()
+	if err != nil {
+		return h, err
+	}
+
+	if count > 0 {
+		h.Values = make(map[string]string, min(count, 64))
+	}
+	for range count {
+		k, err := r.string()
+		if err != nil {
+			return h, err
+		}
+
+		v, err := r.string()
+		if err != nil {
+			return h, err
+		}
+
+		h.Values[k] = v
+	}
+
+	return h, nil
+}
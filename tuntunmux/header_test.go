@@ -0,0 +1,50 @@
+package tuntunmux
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundtrip(t *testing.T) {
+	h := Header{Type: "rpc", Values: map[string]string{"method": "Ping", "": "empty key"}}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteHeader(&buf, h))
+	buf.WriteString("payload")
+
+	got, err := ReadHeader(&buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, h, got)
+	assert.Equal(t, "Ping", got.Get("method"))
+	assert.Equal(t, "payload", buf.String())
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	h := Header{Values: map[string]string{"big": strings.Repeat("x", MaxHeaderSize)}}
+
+	require.Error(t, WriteHeader(&bytes.Buffer{}, h))
+}
+
+func TestHeaderMalformed(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte{headerV1, 2, 0, 10, 'a'}))
+	require.Error(t, err)
+
+	_, err = ReadHeader(bytes.NewReader([]byte{42, 0, 0}))
+	require.Error(t, err)
+}
+
+func TestStatus(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeStatus(&buf, statusAccepted))
+	require.NoError(t, writeStatus(&buf, statusRefused))
+
+	require.NoError(t, readStatus(&buf))
+	require.ErrorIs(t, readStatus(&buf), ErrStreamRefused)
+
+	require.Error(t, readStatus(bytes.NewReader([]byte{headerV1, 42})))
+}
@@ -3,20 +3,78 @@ package tuntunmux
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
 )
 
+var sessionIDc atomic.Uint64
+
+// logger adapts yamux's log.Logger-style output to slog, it is a no-op when no
+// slog.Logger is set.
 type logger struct {
 	logger *slog.Logger
 	ctx    context.Context
 }
 
+// sessionLogger returns l annotated with the session ID and the remote address
+// of conn, or nil when l is nil.
+func sessionLogger(l *slog.Logger, conn io.ReadWriteCloser) *slog.Logger {
+	if l == nil {
+		return nil
+	}
+
+	attrs := []any{slog.Uint64("session_id", sessionIDc.Add(1))}
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		attrs = append(attrs, slog.String("remote_addr", c.RemoteAddr().String()))
+	}
+
+	return l.With(attrs...)
+}
+
+var levelPrefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"[ERR]", slog.LevelError},
+	{"[ERROR]", slog.LevelError},
+	{"[WARN]", slog.LevelWarn},
+	{"[INFO]", slog.LevelInfo},
+	{"[DEBUG]", slog.LevelDebug},
+}
+
+func parseLevel(msg string) (slog.Level, string) {
+	for _, p := range levelPrefixes {
+		if strings.HasPrefix(msg, p.prefix) {
+			return p.level, strings.TrimSpace(msg[len(p.prefix):])
+		}
+	}
+
+	return slog.LevelInfo, msg
+}
+
+func (l logger) log(msg string) {
+	if l.logger == nil {
+		return
+	}
+
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	level, msg := parseLevel(strings.TrimSuffix(msg, "\n"))
+	l.logger.Log(ctx, level, msg)
+}
+
 func (l logger) Print(v ...interface{}) {
-	l.logger.Log(l.ctx, slog.LevelError, fmt.Sprint(v...))
+	l.log(fmt.Sprint(v...))
 }
 
 func (l logger) Printf(format string, v ...interface{}) {
-	l.logger.Log(l.ctx, slog.LevelError, fmt.Sprintf(format, v...))
+	l.log(fmt.Sprintf(format, v...))
 }
 
 func (l logger) Println(v ...interface{}) {
@@ -0,0 +1,57 @@
+package tuntunmux
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	lg := logger{logger: sessionLogger(l, c1), ctx: t.Context()}
+
+	lg.Printf("[WARN] yamux: keepalive failed: %v", "i/o timeout")
+	lg.Println("[ERR] yamux: Failed to write header")
+	lg.Print("[DEBUG] yamux: ping")
+	lg.Print("no prefix")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, string(lines[0]), `level=WARN msg="yamux: keepalive failed: i/o timeout"`)
+		assert.Contains(t, string(lines[1]), `level=ERROR msg="yamux: Failed to write header"`)
+		assert.Contains(t, string(lines[2]), `level=DEBUG msg="yamux: ping"`)
+		assert.Contains(t, string(lines[3]), `level=INFO msg="no prefix"`)
+	}
+
+	assert.Contains(t, string(lines[0]), "session_id=")
+	assert.Contains(t, string(lines[0]), "remote_addr=pipe")
+}
+
+func TestLoggerNil(t *testing.T) {
+	lg := logger{logger: sessionLogger(nil, nil), ctx: t.Context()}
+
+	assert.NotPanics(t, func() {
+		lg.Printf("[ERR] yamux: %v", "boom")
+	})
+
+	assert.NotPanics(t, func() {
+		logger{}.Print("[WARN] yamux: boom")
+	})
+}
@@ -0,0 +1,247 @@
+package tuntunmux
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+var ErrRemoteGoAway = errors.New("mux: remote end is not accepting streams")
+
+// Muxer establishes sessions multiplexing streams over a single conn.
+type Muxer interface {
+	// Name identifies the muxer in logs.
+	Name() string
+	Client(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error)
+	Server(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error)
+}
+
+// Session is one multiplexed conn.
+type Session interface {
+	// Open opens a stream, it returns ErrRemoteGoAway once the remote end is
+	// draining the session.
+	Open(ctx context.Context) (net.Conn, error)
+	// Accept waits for the next stream opened by the remote end, it returns
+	// ErrSessionClosed once the session is closed.
+	Accept(ctx context.Context) (net.Conn, error)
+	NumStreams() int
+	// GoAway tells the remote end to stop opening streams.
+	GoAway() error
+	Ping() (time.Duration, error)
+	Close() error
+	IsClosed() bool
+	CloseChan() <-chan struct{}
+}
+
+// prefixMatcher is implemented by muxers whose client speaks first, letting a
+// Server configured with several muxers pick the one used by the client.
+type prefixMatcher interface {
+	matchPrefix(b byte) bool
+}
+
+// verifier is implemented by muxers able to validate their configuration before
+// a conn is opened.
+type verifier interface {
+	verify() error
+}
+
+// trySender is implemented by streams able to write only what fits in their flow
+// control window, rather than waiting for the window to be updated.
+type trySender interface {
+	trySend(p []byte) (int, error)
+}
+
+// Yamux returns a Muxer backed by hashicorp/yamux, this is the default.
+func Yamux(opts ...SessionOption) Muxer {
+	return yamuxMuxer{opts: opts}
+}
+
+type yamuxMuxer struct {
+	opts []SessionOption
+}
+
+func (m yamuxMuxer) Name() string {
+	return "yamux"
+}
+
+func (m yamuxMuxer) verify() error {
+	_, err := newConfig(m.opts)
+
+	return err
+}
+
+func (m yamuxMuxer) matchPrefix(b byte) bool {
+	// every yamux frame starts with the protocol version
+	return b == 0
+}
+
+func (m yamuxMuxer) config(ctx context.Context, l *slog.Logger) (*yamux.Config, error) {
+	cfg, err := newConfig(m.opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger = logger{logger: l, ctx: ctx}
+
+	return cfg, nil
+}
+
+func (m yamuxMuxer) Client(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error) {
+	cfg, err := m.config(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := yamux.Client(conn, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return yamuxSession{sess}, nil
+}
+
+func (m yamuxMuxer) Server(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error) {
+	cfg, err := m.config(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := yamux.Server(conn, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return yamuxSession{sess}, nil
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (s yamuxSession) Open(ctx context.Context) (net.Conn, error) {
+	conn, err := s.Session.OpenStream()
+	if err != nil {
+		switch {
+		case errors.Is(err, yamux.ErrRemoteGoAway):
+			return nil, ErrRemoteGoAway
+		case errors.Is(err, yamux.ErrSessionShutdown):
+			return nil, ErrSessionClosed
+		}
+
+		return nil, err
+	}
+
+	return &yamuxStream{Stream: conn}, nil
+}
+
+func (s yamuxSession) Accept(ctx context.Context) (net.Conn, error) {
+	conn, err := s.Session.AcceptStreamWithContext(ctx)
+	if err != nil {
+		if errors.Is(err, yamux.ErrSessionShutdown) || errors.Is(err, io.EOF) {
+			return nil, ErrSessionClosed
+		}
+
+		return nil, err
+	}
+
+	return &yamuxStream{Stream: conn}, nil
+}
+
+type yamuxStream struct {
+	*yamux.Stream
+
+	mu        sync.Mutex
+	wdeadline time.Time
+}
+
+// trySend relies on a yamux write with an expired deadline sending what fits in
+// the window before returning ErrTimeout along with the bytes written.
+func (s *yamuxStream) trySend(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.Stream.SetWriteDeadline(time.Unix(1, 0))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := s.Stream.Write(p)
+
+	derr := s.Stream.SetWriteDeadline(s.wdeadline)
+	if errors.Is(err, yamux.ErrTimeout) {
+		err = nil
+	}
+	if err == nil {
+		err = derr
+	}
+
+	return n, err
+}
+
+func (s *yamuxStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wdeadline = t
+
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *yamuxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wdeadline = t
+
+	return s.Stream.SetWriteDeadline(t)
+}
+
+// resetStream aborts a stream so that the remote end fails to read and write it
+// rather than reading EOF, streams that cannot be reset, e.g. yamux ones, are
+// closed.
+func resetStream(conn net.Conn) error {
+	if c, ok := conn.(interface{ Reset() error }); ok {
+		return c.Reset()
+	}
+
+	return conn.Close()
+}
+
+// sniff picks the muxer used by the client among muxers, by peeking at the
+// first byte it sends.
+func sniff(conn net.Conn, muxers []Muxer) (net.Conn, Muxer, error) {
+	if len(muxers) == 1 {
+		return conn, muxers[0], nil
+	}
+
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn = &prefixedConn{Conn: conn, r: br}
+
+	for _, m := range muxers {
+		if pm, ok := m.(prefixMatcher); ok && pm.matchPrefix(b[0]) {
+			return conn, m, nil
+		}
+	}
+
+	return nil, nil, errors.New("mux: unable to detect muxer")
+}
+
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,353 @@
+package tuntunmux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tuntuntun"
+	"tuntuntun/tuntunh2"
+
+	"golang.org/x/net/http2"
+)
+
+const h2StreamURL = "http://tuntunmux/stream"
+
+// H2 returns a Muxer carrying every stream as an HTTP/2 request over the conn,
+// with keepalive pings sent every keepAlive, zero disables them.
+func H2(keepAlive time.Duration) Muxer {
+	return h2Muxer{keepAlive: keepAlive}
+}
+
+type h2Muxer struct {
+	keepAlive time.Duration
+}
+
+func (m h2Muxer) Name() string {
+	return "h2"
+}
+
+func (m h2Muxer) matchPrefix(b byte) bool {
+	// the client connection preface starts with "PRI * HTTP/2.0"
+	return b == 'P'
+}
+
+func (m h2Muxer) Client(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error) {
+	nconn := newNotifyConn(conn)
+
+	t := &http2.Transport{
+		AllowHTTP:       true,
+		ReadIdleTimeout: m.keepAlive,
+		// wait for a slot rather than failing once the server stream limit is hit
+		StrictMaxConcurrentStreams: true,
+	}
+
+	cc, err := t.NewClientConn(nconn)
+	if err != nil {
+		return nil, err
+	}
+
+	client := tuntunh2.NewClient(h2StreamURL, tuntunh2.WithH2C())
+	client.Client = &http.Client{Transport: cc}
+
+	return &h2ClientSession{cc: cc, client: client, conn: nconn}, nil
+}
+
+func (m h2Muxer) Server(ctx context.Context, conn net.Conn, l *slog.Logger) (Session, error) {
+	nconn := newNotifyConn(conn)
+
+	s := &h2ServerSession{
+		conn:   nconn,
+		accept: make(chan *h2Stream),
+		served: make(chan struct{}),
+		hs:     &http.Server{},
+	}
+	s.h2 = tuntunh2.NewServer(tuntuntun.HandlerFunc(s.serveConn))
+
+	h2s := &http2.Server{
+		MaxConcurrentStreams: 1000,
+	}
+	if m.keepAlive > 0 {
+		h2s.ReadIdleTimeout = m.keepAlive
+	}
+
+	err := http2.ConfigureServer(s.hs, h2s)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(s.served)
+		defer nconn.Close()
+
+		h2s.ServeConn(nconn, &http2.ServeConnOpts{
+			Context:    context.WithoutCancel(ctx),
+			BaseConfig: s.hs,
+			Handler:    http.HandlerFunc(s.serveHTTP),
+		})
+	}()
+
+	return s, nil
+}
+
+type h2ClientSession struct {
+	cc      *http2.ClientConn
+	client  *tuntunh2.Client
+	conn    *notifyConn
+	streams atomic.Int64
+}
+
+func (s *h2ClientSession) Open(ctx context.Context) (net.Conn, error) {
+	if s.conn.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	if !s.cc.CanTakeNewRequest() {
+		return nil, ErrRemoteGoAway
+	}
+
+	// The stream outlives ctx, which only bounds its establishment.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	conn, res, err := s.client.Connect(streamCtx)
+	if err != nil {
+		cancel()
+
+		if res != nil && res.StatusCode == http.StatusServiceUnavailable {
+			return nil, ErrRemoteGoAway
+		}
+
+		if !s.cc.CanTakeNewRequest() && !s.conn.IsClosed() {
+			return nil, ErrRemoteGoAway
+		}
+
+		return nil, err
+	}
+
+	s.streams.Add(1)
+
+	return &h2Stream{
+		Conn: conn.(*tuntunh2.Conn),
+		conn: s.conn,
+		onClose: func() {
+			cancel()
+			s.streams.Add(-1)
+		},
+	}, nil
+}
+
+func (s *h2ClientSession) Accept(ctx context.Context) (net.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.conn.Done():
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *h2ClientSession) NumStreams() int {
+	return int(s.streams.Load())
+}
+
+func (s *h2ClientSession) GoAway() error {
+	go s.cc.Shutdown(context.Background())
+
+	return nil
+}
+
+func (s *h2ClientSession) Ping() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := s.cc.Ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+func (s *h2ClientSession) Close() error {
+	err := s.cc.Close()
+	_ = s.conn.Close()
+
+	return err
+}
+
+func (s *h2ClientSession) IsClosed() bool {
+	return s.conn.IsClosed()
+}
+
+func (s *h2ClientSession) CloseChan() <-chan struct{} {
+	return s.conn.Done()
+}
+
+type h2ServerSession struct {
+	conn    *notifyConn
+	accept  chan *h2Stream
+	served  chan struct{}
+	hs      *http.Server
+	h2      *tuntunh2.Server
+	goAway  atomic.Bool
+	streams atomic.Int64
+}
+
+func (s *h2ServerSession) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.goAway.Load() {
+		http.Error(w, "going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.h2.ServeHTTP(w, r)
+}
+
+// errStreamReset makes tuntunh2 reset the stream.
+var errStreamReset = errors.New("mux: stream reset")
+
+// serveConn hands the stream to Accept, and holds its request until it is
+// closed or reset.
+func (s *h2ServerSession) serveConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	st := &h2Stream{
+		Conn:  conn.(*tuntunh2.Conn),
+		conn:  s.conn,
+		reset: make(chan struct{}),
+	}
+
+	select {
+	case s.accept <- st:
+	case <-s.conn.Done():
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+
+	s.streams.Add(1)
+	defer s.streams.Add(-1)
+
+	// ctx is cancelled once the stream is closed
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-st.reset:
+		return errStreamReset
+	}
+}
+
+func (s *h2ServerSession) Open(ctx context.Context) (net.Conn, error) {
+	return nil, errors.New("mux: h2 server sessions cannot open streams")
+}
+
+func (s *h2ServerSession) Accept(ctx context.Context) (net.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.conn.Done():
+		return nil, ErrSessionClosed
+	case st := <-s.accept:
+		return st, nil
+	}
+}
+
+func (s *h2ServerSession) NumStreams() int {
+	return int(s.streams.Load())
+}
+
+func (s *h2ServerSession) GoAway() error {
+	s.goAway.Store(true)
+
+	// sends a GOAWAY frame on the conns served with hs, it has no listener nor
+	// tracked conn so it does not wait
+	return s.hs.Shutdown(context.Background())
+}
+
+func (s *h2ServerSession) Ping() (time.Duration, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// h2CloseTimeout bounds how long Close waits for a session that was sent a
+// GoAway to flush the responses of its last streams.
+const h2CloseTimeout = 2 * time.Second
+
+func (s *h2ServerSession) Close() error {
+	if s.goAway.Load() {
+		// responses are written asynchronously, closing the conn right away
+		// could cut the last ones short, the conn gets closed once they are
+		// sent instead
+		select {
+		case <-s.served:
+		case <-time.After(h2CloseTimeout):
+		}
+	}
+
+	return s.conn.Close()
+}
+
+func (s *h2ServerSession) IsClosed() bool {
+	return s.conn.IsClosed()
+}
+
+func (s *h2ServerSession) CloseChan() <-chan struct{} {
+	return s.conn.Done()
+}
+
+// h2Stream is a tuntunh2 conn carried by a request of the session, reporting
+// the addresses of the session conn. Its deadlines and half-close are the ones
+// of tuntunh2.Conn.
+type h2Stream struct {
+	*tuntunh2.Conn
+	conn net.Conn
+
+	closeOnce sync.Once
+	onClose   func()
+
+	// reset is closed to reset a server stream
+	reset     chan struct{}
+	resetOnce sync.Once
+}
+
+var _ net.Conn = (*h2Stream)(nil)
+
+func (s *h2Stream) Close() error {
+	err := s.Conn.Close()
+
+	if s.onClose != nil {
+		s.closeOnce.Do(s.onClose)
+	}
+
+	return err
+}
+
+// Reset aborts the stream, the remote end fails to read it rather than reading
+// EOF. Closing a client stream already resets it.
+func (s *h2Stream) Reset() error {
+	if s.reset == nil {
+		return s.Close()
+	}
+
+	s.resetOnce.Do(func() {
+		close(s.reset)
+	})
+
+	return nil
+}
+
+func (s *h2Stream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *h2Stream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
@@ -0,0 +1,278 @@
+package tuntunmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Priority is the scheduling class of a stream, streams of a session share its
+// conn in proportion to the weight of their class.
+type Priority uint8
+
+const (
+	PriorityDefault Priority = iota
+	// PriorityInteractive is for latency sensitive streams, e.g. SSH.
+	PriorityInteractive
+	// PriorityBulk is for throughput oriented streams, e.g. downloads.
+	PriorityBulk
+
+	numPriorities = 3
+)
+
+// PriorityHeaderKey is the Header value carrying the priority of a stream, when
+// headers are enabled.
+const PriorityHeaderKey = "priority"
+
+var priorityNames = [numPriorities]string{"default", "interactive", "bulk"}
+
+var priorityWeights = [numPriorities]uint64{
+	PriorityDefault:     4,
+	PriorityInteractive: 16,
+	PriorityBulk:        1,
+}
+
+func (p Priority) String() string {
+	if int(p) < numPriorities {
+		return priorityNames[p]
+	}
+
+	return fmt.Sprintf("priority(%d)", p)
+}
+
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if s == name {
+			return Priority(i), nil
+		}
+	}
+
+	return PriorityDefault, fmt.Errorf("unknown priority: %q", s)
+}
+
+type priorityKey struct{}
+
+// ContextWithPriority sets the priority of the streams opened with ctx by a
+// Client, it is also set on the context of the streams served by a Server.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+
+	return p
+}
+
+// headerPriority reads the priority from the incoming stream header, this is the
+// default priority of the streams served by a Server.
+func headerPriority(ctx context.Context) Priority {
+	h, ok := HeaderFromContext(ctx)
+	if !ok {
+		return PriorityDefault
+	}
+
+	p, err := ParsePriority(h.Get(PriorityHeaderKey))
+	if err != nil {
+		return PriorityDefault
+	}
+
+	return p
+}
+
+// withPriorityHeader returns h carrying p, leaving h untouched.
+func withPriorityHeader(h Header, p Priority) Header {
+	values := make(map[string]string, len(h.Values)+1)
+	for k, v := range h.Values {
+		values[k] = v
+	}
+	values[PriorityHeaderKey] = p.String()
+	h.Values = values
+
+	return h
+}
+
+const (
+	// schedChunkSize is the largest write a stream makes per turn.
+	schedChunkSize = 16 * 1024
+	// schedStallTimeout is how long a turn may be held while others are
+	// waiting, so that a stream blocked on its flow control window, or whose
+	// window cannot be known, does not hold up the others.
+	schedStallTimeout = 20 * time.Millisecond
+)
+
+// scheduler hands out turns to write to a session with start-time fair
+// queuing: each turn gets a virtual start tag, advanced by its size over the
+// weight of its class, and the waiting turn with the lowest tag goes next.
+type scheduler struct {
+	stallTimeout time.Duration
+
+	mu      sync.Mutex
+	cur     *turn
+	stall   *time.Timer
+	vtime   uint64
+	finish  [numPriorities]uint64
+	waiting [numPriorities][]*turn
+}
+
+type turn struct {
+	s     *scheduler
+	start uint64
+	ready chan struct{}
+	once  sync.Once
+}
+
+func (t *turn) release() {
+	t.once.Do(t.s.next)
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{stallTimeout: schedStallTimeout}
+}
+
+// acquire waits for a turn to write n bytes at priority p, the returned turn
+// must be released once written.
+func (s *scheduler) acquire(p Priority, n int) *turn {
+	if int(p) >= numPriorities {
+		p = PriorityDefault
+	}
+
+	s.mu.Lock()
+
+	start := max(s.finish[p], s.vtime)
+	s.finish[p] = start + uint64(n)*priorityWeights[PriorityInteractive]/priorityWeights[p]
+
+	t := &turn{s: s, start: start}
+
+	if s.cur == nil {
+		s.cur = t
+		s.vtime = start
+		s.mu.Unlock()
+
+		return t
+	}
+
+	t.ready = make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], t)
+	if s.stall == nil {
+		s.stall = time.AfterFunc(s.stallTimeout, s.cur.release)
+	}
+
+	s.mu.Unlock()
+
+	<-t.ready
+
+	return t
+}
+
+// next hands the turn over to the waiting turn with the lowest start tag.
+func (s *scheduler) next() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stall != nil {
+		s.stall.Stop()
+		s.stall = nil
+	}
+
+	next := -1
+	for p, q := range s.waiting {
+		if len(q) == 0 {
+			continue
+		}
+		if next < 0 || q[0].start < s.waiting[next][0].start {
+			next = p
+		}
+	}
+
+	if next < 0 {
+		s.cur = nil
+		return
+	}
+
+	t := s.waiting[next][0]
+	s.waiting[next][0] = nil
+	s.waiting[next] = s.waiting[next][1:]
+
+	s.cur = t
+	s.vtime = t.start
+
+	for _, q := range s.waiting {
+		if len(q) > 0 {
+			s.stall = time.AfterFunc(s.stallTimeout, t.release)
+			break
+		}
+	}
+
+	close(t.ready)
+}
+
+// scheduledConn writes through the scheduler of its session.
+type scheduledConn struct {
+	net.Conn
+	sched    *scheduler
+	priority Priority
+	// ts is set when the stream can write what fits in its flow control
+	// window, so that the turn is not held waiting for it.
+	ts trySender
+
+	wmu sync.Mutex
+}
+
+func newScheduledConn(conn net.Conn, sched *scheduler, p Priority) *scheduledConn {
+	ts, _ := conn.(trySender)
+
+	return &scheduledConn{Conn: conn, sched: sched, priority: p, ts: ts}
+}
+
+func (c *scheduledConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), schedChunkSize)]
+
+		n, err := c.writeChunk(chunk)
+
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// writeChunk writes p in a turn. When the flow control window runs out, the
+// turn is released and the rest of p is written once the window is updated.
+func (c *scheduledConn) writeChunk(p []byte) (int, error) {
+	t := c.sched.acquire(c.priority, len(p))
+	if c.ts == nil {
+		n, err := c.Conn.Write(p)
+		t.release()
+
+		return n, err
+	}
+
+	n, err := c.ts.trySend(p)
+	t.release()
+	if err != nil || n == len(p) {
+		return n, err
+	}
+
+	m, err := c.Conn.Write(p[n:])
+
+	return n + m, err
+}
+
+func (c *scheduledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
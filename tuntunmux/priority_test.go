@@ -0,0 +1,256 @@
+package tuntunmux
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"tuntuntun"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PriorityDefault, PriorityInteractive, PriorityBulk} {
+		got, err := ParsePriority(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, got)
+	}
+
+	_, err := ParsePriority("urgent")
+	require.Error(t, err)
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := newScheduler()
+	s.stallTimeout = time.Hour
+
+	holder := s.acquire(PriorityDefault, schedChunkSize)
+
+	var mu sync.Mutex
+	var order []Priority
+
+	var wg sync.WaitGroup
+	enqueue := func(p Priority) {
+		s.mu.Lock()
+		waiting := len(s.waiting[p])
+		s.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			t := s.acquire(p, schedChunkSize)
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			t.release()
+		}()
+
+		// wait for the turn to be queued, to control the arrival order
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			return len(s.waiting[p]) > waiting
+		}, time.Second, time.Millisecond)
+	}
+
+	// bulk turns arrive first, yet interactive ones get ahead of all but one
+	for range 4 {
+		enqueue(PriorityBulk)
+	}
+	for range 4 {
+		enqueue(PriorityInteractive)
+	}
+
+	holder.release()
+	wg.Wait()
+
+	assert.Equal(t, []Priority{
+		PriorityInteractive,
+		PriorityBulk,
+		PriorityInteractive,
+		PriorityInteractive,
+		PriorityInteractive,
+		PriorityBulk,
+		PriorityBulk,
+		PriorityBulk,
+	}, order)
+}
+
+func TestSchedulerStall(t *testing.T) {
+	s := newScheduler()
+	s.stallTimeout = 10 * time.Millisecond
+
+	// never released, as a stream stuck on its flow control window
+	_ = s.acquire(PriorityBulk, schedChunkSize)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		s.acquire(PriorityInteractive, 1).release()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stalled turn was not preempted")
+	}
+}
+
+func TestStreamPriority(t *testing.T) {
+	received := make(chan Priority, 3)
+
+	srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		received <- PriorityFromContext(ctx)
+
+		_, err := conn.Write([]byte("ok"))
+		return err
+	}), WithServerHeaders())
+
+	c := NewClient(listen(t, srv), WithClientHeaders())
+	defer c.Close()
+
+	for _, p := range []Priority{PriorityInteractive, PriorityBulk, PriorityDefault} {
+		conn, err := c.Open(ContextWithPriority(t.Context(), p))
+		require.NoError(t, err)
+
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		conn.Close()
+
+		assert.Equal(t, p, <-received)
+	}
+}
+
+func TestStreamPriorityLatency(t *testing.T) {
+	srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		if PriorityFromContext(ctx) == PriorityBulk {
+			// read slowly, so that the bulk stream keeps running out of window
+			buf := make([]byte, schedChunkSize)
+			for {
+				_, err := conn.Read(buf)
+				if err != nil {
+					return nil
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		_, err := io.Copy(conn, conn)
+		return err
+	}), WithServerHeaders())
+
+	c := NewClient(listen(t, srv), WithClientHeaders())
+	defer c.Close()
+
+	bulk, err := c.Open(ContextWithPriority(t.Context(), PriorityBulk))
+	require.NoError(t, err)
+	defer bulk.Close()
+
+	go func() {
+		buf := make([]byte, 1024*1024)
+		for {
+			_, err := bulk.Write(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := c.Open(ContextWithPriority(t.Context(), PriorityInteractive))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// let the bulk stream fill its window
+	time.Sleep(100 * time.Millisecond)
+
+	var slowest time.Duration
+	buf := make([]byte, 1)
+	for range 50 {
+		start := time.Now()
+
+		_, err = conn.Write([]byte("x"))
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+
+		slowest = max(slowest, time.Since(start))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	assert.Less(t, slowest, schedStallTimeout/2)
+}
+
+// TestYamuxTrySend fails if a yamux write with an expired deadline stops
+// returning what fit in the window along with ErrTimeout, trySend relies on it.
+func TestYamuxTrySend(t *testing.T) {
+	cconn, sconn := net.Pipe()
+
+	var m yamuxMuxer
+
+	client, err := m.Client(t.Context(), cconn, nil)
+	require.NoError(t, err)
+	defer client.Close()
+
+	server, err := m.Server(t.Context(), sconn, nil)
+	require.NoError(t, err)
+	defer server.Close()
+
+	// accept the streams without reading them, so that the window is not updated
+	go func() {
+		for {
+			_, err := server.Accept(t.Context())
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	window := int(yamux.DefaultConfig().MaxStreamWindowSize)
+
+	t.Run("yamux", func(t *testing.T) {
+		conn, err := client.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		stream := conn.(*yamuxStream).Stream
+		require.NoError(t, stream.SetWriteDeadline(time.Unix(1, 0)))
+
+		n, err := stream.Write(make([]byte, window+1024))
+		require.ErrorIs(t, err, yamux.ErrTimeout)
+		assert.Equal(t, window, n)
+	})
+
+	t.Run("trySend", func(t *testing.T) {
+		conn, err := client.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SetWriteDeadline(time.Now().Add(200*time.Millisecond)))
+
+		ts := conn.(trySender)
+
+		n, err := ts.trySend(make([]byte, window-1024))
+		require.NoError(t, err)
+		assert.Equal(t, window-1024, n)
+
+		n, err = ts.trySend(make([]byte, 2048))
+		require.NoError(t, err)
+		assert.Equal(t, 1024, n)
+
+		// the write deadline is restored, the write waits for it
+		start := time.Now()
+		_, err = conn.Write([]byte("x"))
+		require.ErrorIs(t, err, yamux.ErrTimeout)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+}
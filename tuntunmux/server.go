@@ -3,13 +3,27 @@ package tuntunmux
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
 	"tuntuntun"
-
-	"github.com/hashicorp/yamux"
 )
 
+const drainPollInterval = 50 * time.Millisecond
+
+// DefaultHeaderTimeout bounds how long the server waits for the header of a
+// stream.
+const DefaultHeaderTimeout = 10 * time.Second
+
+// DefaultStatsInterval is used by WithServerStats when the interval is not
+// positive.
+const DefaultStatsInterval = time.Minute
+
+var ErrHeadersRequired = errors.New("mux: client does not send stream headers")
+
 type ServerOption func(s *Server)
 
 func WithServerLogger(l *slog.Logger) ServerOption {
@@ -18,60 +32,238 @@ func WithServerLogger(l *slog.Logger) ServerOption {
 	}
 }
 
+// WithServerSession tunes the yamux sessions served by the server, when using
+// the default muxer.
+func WithServerSession(opts ...SessionOption) ServerOption {
+	return func(s *Server) {
+		s.sessionOpts = append(s.sessionOpts, opts...)
+	}
+}
+
+// WithServerMuxers sets the muxers supported by the server, yamux by default.
+// When several are given, the one used by the client is detected from the
+// first bytes it sends.
+func WithServerMuxers(m ...Muxer) ServerOption {
+	return func(s *Server) {
+		s.muxers = m
+	}
+}
+
+// WithServerPriority sets how the priority of the served streams is picked, by
+// default it is read from the stream header, see PriorityHeaderKey.
+func WithServerPriority(f func(ctx context.Context) Priority) ServerOption {
+	return func(s *Server) {
+		s.priority = f
+	}
+}
+
+// WithServerStats registers a function called with the stats of every session
+// each interval, and once more when the session ends.
+func WithServerStats(interval time.Duration, f func(ctx context.Context, stats SessionStats)) ServerOption {
+	return func(s *Server) {
+		if interval <= 0 {
+			interval = DefaultStatsInterval
+		}
+		s.statsInterval = interval
+		s.statsFunc = f
+	}
+}
+
+// WithServerMaxStreams limits the number of concurrently served streams per
+// session. Excess streams are refused as soon as they are accepted: Open fails
+// with ErrStreamRefused on clients using WithClientHeaders, the stream is reset,
+// or closed with yamux, for the others.
+func WithServerMaxStreams(n int) ServerOption {
+	return func(s *Server) {
+		s.maxStreams = n
+	}
+}
+
+// WithServerDrainTimeout makes ServeConn shut down gracefully when its context
+// is cancelled: the session sends a GoAway, refuses new streams and waits up to
+// d for the active ones to finish before closing.
+func WithServerDrainTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.drainTimeout = d
+	}
+}
+
+// WithServerHeaders makes the server require a Header at the start of every
+// stream, available to the handler with HeaderFromContext: sessions of clients
+// not configured with WithClientHeaders are refused with ErrHeadersRequired.
+// The headers of clients announcing them are read either way.
+func WithServerHeaders() ServerOption {
+	return func(s *Server) {
+		s.headers = true
+	}
+}
+
+// WithServerHeaderTimeout sets how long the server waits for the header of a
+// stream before resetting it, DefaultHeaderTimeout by default.
+func WithServerHeaderTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		if d > 0 {
+			s.headerTimeout = d
+		}
+	}
+}
+
 type Server struct {
-	handler tuntuntun.Handler
-	logger  *slog.Logger
+	handler       tuntuntun.Handler
+	logger        *slog.Logger
+	sessionOpts   []SessionOption
+	muxers        []Muxer
+	maxStreams    int
+	drainTimeout  time.Duration
+	headers       bool
+	headerTimeout time.Duration
+	priority      func(ctx context.Context) Priority
+	statsInterval time.Duration
+	statsFunc     func(ctx context.Context, stats SessionStats)
 }
 
 func NewServer(h tuntuntun.Handler, opts ...ServerOption) *Server {
 	s := &Server{
-		handler: h,
+		handler:       h,
+		headerTimeout: DefaultHeaderTimeout,
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
 
+	if s.priority == nil {
+		s.priority = headerPriority
+	}
+
+	if len(s.muxers) == 0 {
+		s.muxers = []Muxer{Yamux(s.sessionOpts...)}
+	}
+
 	return s
 }
 
 func (s *Server) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
 	defer conn.Close()
 
-	cfg := yamux.DefaultConfig()
-	cfg.Logger = logger{logger: s.logger, ctx: ctx}
-	cfg.LogOutput = nil
+	// the client may never speak
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	nconn, flags, err := readPreamble(asNetConn(conn))
+	if !stop() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	headers := flags&preambleHeaders != 0
+	status := flags&preambleStatus != 0
+	if s.headers && !headers {
+		return ErrHeadersRequired
+	}
+
+	nconn, muxer, err := sniff(nconn, s.muxers)
+	if err != nil {
+		return err
+	}
+
+	cconn := newCountingConn(nconn)
 
-	sess, err := yamux.Server(conn, cfg)
+	sess, err := muxer.Server(ctx, cconn, sessionLogger(s.logger, conn))
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
 
+	// Streams outlive the serve context while draining, until the drain deadline.
+	streamCtx, cancelStreams := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelStreams()
+
+	var active atomic.Int64
+
+	sched := newScheduler()
+
+	stats := newSessionStats()
+	if s.statsFunc != nil {
+		go stats.trackRTT(sess)
+		go s.reportStats(ctx, sess, func() SessionStats {
+			return stats.snapshot(int(active.Load()), cconn)
+		})
+	}
+
 	go func() {
 		select {
 		case <-ctx.Done():
+			if s.drainTimeout > 0 {
+				s.drain(ctx, sess, &active)
+			}
+			cancelStreams()
 			sess.Close()
 		case <-sess.CloseChan():
 		}
 	}()
 
 	for {
-		conn, err := sess.AcceptStreamWithContext(ctx)
+		conn, err := sess.Accept(streamCtx)
 		if err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) {
+			if ctx.Err() != nil || errors.Is(err, ErrSessionClosed) || errors.Is(err, io.EOF) {
 				return nil
 			}
 
 			return err
 		}
 
+		if s.maxStreams > 0 && active.Load() >= int64(s.maxStreams) {
+			if s.logger != nil {
+				s.logger.Log(ctx, slog.LevelWarn, "mux: max streams reached, refusing stream", slog.Int("max", s.maxStreams))
+			}
+			go func() {
+				// the client expects its header to be read before the status
+				if headers {
+					_, _ = s.readHeader(conn)
+				}
+				refuse(conn, status)
+			}()
+			continue
+		}
+
+		active.Add(1)
+		stats.streams.Add(1)
 		go func() {
+			defer active.Add(-1)
 			defer conn.Close()
 
-			ctx, cancel := context.WithCancel(ctx)
+			ctx, cancel := context.WithCancel(streamCtx)
 			defer cancel()
 
-			err := s.handler.ServeConn(ctx, conn)
+			if headers {
+				h, err := s.readHeader(conn)
+				if err != nil {
+					if s.logger != nil {
+						s.logger.Log(ctx, slog.LevelError, "mux: failed to read header", slog.String("err", err.Error()))
+					}
+					refuse(conn, status)
+					return
+				}
+
+				ctx = contextWithIncomingHeader(ctx, h)
+			}
+
+			if status {
+				err := writeStatus(conn, statusAccepted)
+				if err != nil {
+					if s.logger != nil {
+						s.logger.Log(ctx, slog.LevelError, "mux: failed to accept stream", slog.String("err", err.Error()))
+					}
+					return
+				}
+			}
+
+			priority := s.priority(ctx)
+			ctx = ContextWithPriority(ctx, priority)
+
+			err := s.handler.ServeConn(ctx, newScheduledConn(conn, sched, priority))
 			if err != nil {
 				if s.logger != nil {
 					s.logger.Log(ctx, slog.LevelError, "mux: failed to serve", slog.String("err", err.Error()))
@@ -80,3 +272,81 @@ func (s *Server) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
 		}()
 	}
 }
+
+// readHeader reads the header of conn, giving up after the header timeout.
+func (s *Server) readHeader(conn net.Conn) (Header, error) {
+	err := conn.SetReadDeadline(time.Now().Add(s.headerTimeout))
+	if err != nil {
+		return Header{}, err
+	}
+
+	h, err := ReadHeader(conn)
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return h, fmt.Errorf("mux: no header after %v", s.headerTimeout)
+		}
+
+		return h, err
+	}
+
+	return h, conn.SetReadDeadline(time.Time{})
+}
+
+// refuse tells the client that its stream is refused when it reads statuses,
+// and resets the stream.
+func refuse(conn net.Conn, status bool) {
+	if status {
+		_ = writeStatus(conn, statusRefused)
+		_ = conn.Close()
+		return
+	}
+
+	_ = resetStream(conn)
+}
+
+// reportStats calls the stats function every interval, until the session ends.
+func (s *Server) reportStats(ctx context.Context, sess Session, snapshot func() SessionStats) {
+	t := time.NewTicker(s.statsInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.statsFunc(ctx, snapshot())
+		case <-sess.CloseChan():
+			s.statsFunc(ctx, snapshot())
+			return
+		}
+	}
+}
+
+// drain sends a GoAway and waits for the active streams, up to the drain timeout.
+func (s *Server) drain(ctx context.Context, sess Session, active *atomic.Int64) {
+	err := sess.GoAway()
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelWarn, "mux: failed to send go away", slog.String("err", err.Error()))
+		}
+		return
+	}
+
+	t := time.NewTimer(s.drainTimeout)
+	defer t.Stop()
+
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+
+	for active.Load() > 0 {
+		select {
+		case <-tick.C:
+		case <-sess.CloseChan():
+			return
+		case <-t.C:
+			if s.logger != nil {
+				s.logger.Log(ctx, slog.LevelWarn, "mux: drain timeout, closing session", slog.Int64("streams", active.Load()))
+			}
+			return
+		}
+	}
+}
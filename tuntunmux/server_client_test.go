@@ -5,9 +5,13 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"tuntuntun"
+	"tuntuntun/tuntuntls"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -56,112 +60,729 @@ func echo(t *testing.T, expected string) tuntuntun.HandlerFunc {
 func TestSanity(t *testing.T) {
 	toWrite := "hello"
 
-	l, err := net.Listen("tcp", ":0")
+	c := NewClient(listen(t, NewServer(echo(t, toWrite))))
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
 	require.NoError(t, err)
-	defer l.Close()
+	defer conn.Close()
+
+	roundtrip(t, conn, toWrite)
+}
+
+func TestStress(t *testing.T) {
+	toWrite := "hello"
+
+	c := NewClient(listen(t, NewServer(echo(t, toWrite))))
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 1000 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			roundtrip(t, conn, toWrite)
+
+			return nil
+		})
+	}
 
+	require.NoError(t, g.Wait())
+}
+
+// listen serves srv on a loopback port until the test ends.
+func listen(t *testing.T, srv *Server) tuntuntun.Opener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
 	go func() {
-		srv := NewServer(echo(t, toWrite))
+		done <- tuntuntls.NewServer(srv, tuntuntls.WithServerPlaintext()).Serve(ctx, l)
+	}()
 
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return tuntuntls.NewClient(l.Addr().String(), tuntuntls.WithPlaintext())
+}
+
+func TestServerMaxStreams(t *testing.T) {
+	for _, m := range []Muxer{Yamux(), H2(time.Second)} {
+		t.Run(m.Name(), func(t *testing.T) {
+			srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+				_, err := conn.Write([]byte("ok"))
+				if err != nil {
+					return err
 				}
 
-				require.NoError(t, err)
-			}
+				// served until the client closes the stream
+				_, err = io.Copy(io.Discard, conn)
+				return err
+			}), WithServerMaxStreams(1), WithServerMuxers(m))
 
-			t.Log("SERVER ACCEPTED:", conn.RemoteAddr())
+			c := NewClient(listen(t, srv), WithClientMuxer(m), WithClientHeaders())
+			defer c.Close()
 
-			go func() {
-				defer conn.Close()
+			conn1, err := c.Open(t.Context())
+			require.NoError(t, err)
+			defer conn1.Close()
+
+			buf := make([]byte, 2)
+			_, err = io.ReadFull(conn1, buf)
+			require.NoError(t, err)
 
-				err := srv.ServeConn(t.Context(), conn)
+			// the server answers the excess stream with a refusal
+			_, err = c.Open(t.Context())
+			require.ErrorIs(t, err, ErrStreamRefused)
+
+			// the refused stream does not count against the limit
+			require.NoError(t, conn1.Close())
+			require.Eventually(t, func() bool {
+				conn, err := c.Open(t.Context())
 				if err != nil {
-					t.Log(err)
+					return false
 				}
-			}()
-		}
-	}()
+				defer conn.Close()
 
+				return true
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+
+	t.Run("without headers", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			<-release
+
+			return nil
+		}), WithServerMaxStreams(1))
+
+		c := NewClient(listen(t, srv))
+		defer c.Close()
+
+		conn1, err := c.Open(t.Context())
+		require.NoError(t, err)
+		defer conn1.Close()
+
+		// the client cannot tell the stream was refused until it reads it
+		require.Eventually(t, func() bool {
+			conn2, err := c.Open(t.Context())
+			require.NoError(t, err)
+			defer conn2.Close()
+
+			require.NoError(t, conn2.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+			_, err = conn2.Read(make([]byte, 1))
+
+			return errors.Is(err, io.EOF)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestInvalidSessionConfig(t *testing.T) {
 	c := NewClient(tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
-		return net.Dial("tcp", l.Addr().String())
-	}))
-	require.NoError(t, err)
+		panic("should not be called")
+	}), WithClientSession(WithWindowSize(1)))
+	defer c.Close()
+
+	_, err := c.Open(t.Context())
+	require.Error(t, err)
+}
+
+func TestClientPool(t *testing.T) {
+	for name, strategy := range map[string]Strategy{"least-streams": LeastStreams, "round-robin": RoundRobin} {
+		t.Run(name, func(t *testing.T) {
+			toWrite := "hello"
+
+			opener := listen(t, NewServer(echo(t, toWrite)))
+
+			var opened atomic.Int64
+			c := NewClient(
+				tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+					opened.Add(1)
+					return opener.Open(ctx)
+				}),
+				WithClientPool(3),
+				WithClientStreamThreshold(2),
+				WithClientStrategy(strategy),
+			)
+			defer c.Close()
+
+			var conns []net.Conn
+			for range 8 {
+				conn, err := c.Open(t.Context())
+				require.NoError(t, err)
+				defer conn.Close()
+
+				conns = append(conns, conn)
+			}
+
+			assert.EqualValues(t, 3, opened.Load())
+
+			c.mu.Lock()
+			for _, s := range c.sessions {
+				assert.GreaterOrEqual(t, s.NumStreams(), 2)
+			}
+			c.mu.Unlock()
+
+			for _, conn := range conns {
+				roundtrip(t, conn, toWrite)
+			}
+		})
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	toWrite := "hello"
+
+	opener := listen(t, NewServer(echo(t, toWrite)))
+
+	var fail atomic.Bool
+	fail.Store(true)
+
+	var statesm sync.Mutex
+	var states []State
+	var errs []error
+
+	c := NewClient(
+		tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+			if fail.Load() {
+				return nil, errors.New("relay down")
+			}
+			return opener.Open(ctx)
+		}),
+		WithClientBackoff(10*time.Millisecond, 50*time.Millisecond),
+		WithClientStateHook(func(state State, err error) {
+			statesm.Lock()
+			defer statesm.Unlock()
+
+			states = append(states, state)
+			errs = append(errs, err)
+		}),
+	)
 	defer c.Close()
 
+	_, err := c.Open(t.Context())
+	require.ErrorContains(t, err, "relay down")
+	assert.Equal(t, StateDown, c.State())
+
+	fail.Store(false)
+
 	conn, err := c.Open(t.Context())
 	require.NoError(t, err)
 	defer conn.Close()
+	assert.Equal(t, StateUp, c.State())
 
 	roundtrip(t, conn, toWrite)
+
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool {
+		return c.State() == StateDown
+	}, time.Second, 10*time.Millisecond)
+
+	statesm.Lock()
+	// the failed dial is reported while down
+	assert.Equal(t, []State{StateDown, StateUp, StateDown}, states)
+	require.Len(t, errs, 3)
+	assert.ErrorContains(t, errs[0], "relay down")
+	assert.NoError(t, errs[1])
+	assert.ErrorIs(t, errs[2], ErrSessionClosed)
+	statesm.Unlock()
 }
 
-func TestStress(t *testing.T) {
-	ctx, cancel := context.WithCancel(t.Context())
-	defer cancel()
+func TestClientStateSessionLost(t *testing.T) {
+	opener := listen(t, NewServer(echo(t, "hello")))
+
+	for range 10 {
+		var statesm sync.Mutex
+		var states []State
+
+		c := NewClient(
+			tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+				conn, err := opener.Open(ctx)
+				if err != nil {
+					return nil, err
+				}
+
+				// the session ends right after it is established
+				go conn.Close()
+
+				return conn, nil
+			}),
+			WithClientBackoff(time.Hour, time.Hour),
+			WithClientStateHook(func(state State, err error) {
+				if state == StateUp {
+					// the session ends while the hook runs
+					time.Sleep(10 * time.Millisecond)
+				}
+
+				statesm.Lock()
+				defer statesm.Unlock()
+
+				states = append(states, state)
+			}),
+		)
+
+		_, _ = c.Open(t.Context())
 
+		require.Eventually(t, func() bool {
+			statesm.Lock()
+			defer statesm.Unlock()
+
+			return c.State() == StateDown && len(states) > 0 && states[len(states)-1] == StateDown
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestClientSharedDial(t *testing.T) {
+	opener := listen(t, NewServer(echo(t, "hello")))
+
+	release := make(chan struct{})
+	var opened atomic.Int64
+
+	c := NewClient(tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+		opened.Add(1)
+		<-release
+		return opener.Open(ctx)
+	}))
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 10 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	require.NoError(t, g.Wait())
+	assert.EqualValues(t, 1, opened.Load())
+}
+
+func TestServerDrain(t *testing.T) {
+	for _, m := range []Muxer{Yamux(), H2(0)} {
+		t.Run(m.Name(), func(t *testing.T) {
+			testServerDrain(t, m)
+		})
+	}
+}
+
+func testServerDrain(t *testing.T, m Muxer) {
 	toWrite := "hello"
 
+	srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		time.Sleep(200 * time.Millisecond)
+
+		return echo(t, toWrite)(ctx, conn)
+	}), WithServerDrainTimeout(5*time.Second), WithServerMuxers(m))
+
 	l, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
 	defer l.Close()
 
-	var wg sync.WaitGroup
+	serveCtx, stopServe := context.WithCancel(t.Context())
+	defer stopServe()
 
+	var accepted atomic.Int64
 	go func() {
-		srv := NewServer(echo(t, toWrite))
-
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
-
-				require.NoError(t, err)
+				return
 			}
 
-			t.Log("SERVER ACCEPTED:", conn.RemoteAddr())
-
-			wg.Add(1)
+			ctx := t.Context()
+			if accepted.Add(1) == 1 {
+				// only the first session gets drained
+				ctx = serveCtx
+			}
 
 			go func() {
-				defer wg.Done()
 				defer conn.Close()
 
-				err := srv.ServeConn(ctx, conn)
-				if err != nil {
-					t.Log(err)
-				}
+				_ = srv.ServeConn(ctx, conn)
 			}()
 		}
 	}()
 
 	c := NewClient(tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
 		return net.Dial("tcp", l.Addr().String())
-	}))
+	}), WithClientMuxer(m))
+	defer c.Close()
+
+	inflight, err := c.Open(t.Context())
 	require.NoError(t, err)
+	defer inflight.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		roundtrip(t, inflight, toWrite)
+	}()
+
+	// make sure the stream reached the server before it starts draining
+	time.Sleep(50 * time.Millisecond)
+	stopServe()
+	// let the GoAway reach the client
+	time.Sleep(50 * time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		conn, err := c.Open(t.Context())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+
+		roundtrip(t, conn, toWrite)
+
+		return accepted.Load() == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	<-done
+}
+
+func TestStreamHeaders(t *testing.T) {
+	received := make(chan Header, 2)
+
+	srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		h, ok := HeaderFromContext(ctx)
+		require.True(t, ok)
+
+		received <- h
+
+		_, err := conn.Write([]byte("ok"))
+		return err
+	}), WithServerHeaders())
+
+	c := NewClient(listen(t, srv), WithClientHeaders())
 	defer c.Close()
 
-	var g errgroup.Group
-	for range 1000 {
-		g.Go(func() error {
-			conn, err := c.Open(t.Context())
-			require.NoError(t, err)
+	sent := Header{Type: "fwd", Values: map[string]string{"addr": "localhost:22", "network": "tcp"}}
+
+	for _, ctx := range []context.Context{ContextWithHeader(t.Context(), sent), t.Context()} {
+		conn, err := c.Open(ctx)
+		require.NoError(t, err)
+
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	assert.Equal(t, sent, <-received)
+	assert.Equal(t, Header{}, <-received)
+}
+
+func TestStreamHeadersNegotiation(t *testing.T) {
+	t.Run("server without headers", func(t *testing.T) {
+		received := make(chan Header, 1)
+
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			h, ok := HeaderFromContext(ctx)
+			require.True(t, ok)
+
+			received <- h
+
+			_, err := conn.Write([]byte("ok"))
+			return err
+		}))
+
+		c := NewClient(listen(t, srv), WithClientHeaders())
+		defer c.Close()
+
+		sent := Header{Type: "fwd"}
+
+		conn, err := c.Open(ContextWithHeader(t.Context(), sent))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, sent, <-received)
+	})
+
+	t.Run("client without headers", func(t *testing.T) {
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			panic("should not be called")
+		}), WithServerHeaders())
+
+		cconn, sconn := net.Pipe()
+
+		done := make(chan error)
+		go func() {
+			done <- srv.ServeConn(t.Context(), sconn)
+		}()
+
+		c := NewClient(tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+			return cconn, nil
+		}))
+		defer c.Close()
+
+		conn, err := c.Open(t.Context())
+		if err == nil {
+			_, _ = conn.Write([]byte("hello"))
 			defer conn.Close()
+		}
 
-			roundtrip(t, conn, toWrite)
+		require.ErrorIs(t, <-done, ErrHeadersRequired)
+	})
 
-			return nil
+	t.Run("header timeout", func(t *testing.T) {
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			panic("should not be called")
+		}), WithServerHeaderTimeout(50*time.Millisecond))
+
+		cconn, sconn := net.Pipe()
+		defer cconn.Close()
+
+		go func() {
+			_ = srv.ServeConn(t.Context(), sconn)
+		}()
+
+		// announces headers but never sends the one of its stream
+		require.NoError(t, writePreamble(cconn, preambleHeaders|preambleStatus))
+
+		sess, err := Yamux().Client(t.Context(), cconn, nil)
+		require.NoError(t, err)
+		defer sess.Close()
+
+		conn, err := sess.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// the stream is refused once the header timeout passed
+		require.ErrorIs(t, readStatus(conn), ErrStreamRefused)
+	})
+}
+
+func TestMuxers(t *testing.T) {
+	toWrite := "hello"
+
+	// the server detects which muxer each client speaks
+	srv := NewServer(echo(t, toWrite), WithServerMuxers(Yamux(), H2(time.Second)))
+	opener := listen(t, srv)
+
+	for _, m := range []Muxer{Yamux(), H2(time.Second)} {
+		t.Run(m.Name(), func(t *testing.T) {
+			c := NewClient(opener, WithClientMuxer(m))
+			defer c.Close()
+
+			var g errgroup.Group
+			for range 200 {
+				g.Go(func() error {
+					conn, err := c.Open(t.Context())
+					if err != nil {
+						return err
+					}
+					defer conn.Close()
+
+					roundtrip(t, conn, toWrite)
+
+					return nil
+				})
+			}
+			require.NoError(t, g.Wait())
+
+			c.mu.Lock()
+			assert.Len(t, c.sessions, 1)
+			c.mu.Unlock()
 		})
 	}
+}
 
-	require.NoError(t, g.Wait())
+func TestH2Stream(t *testing.T) {
+	t.Run("half close", func(t *testing.T) {
+		received := make(chan string, 1)
+
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			_, err := conn.Write([]byte("hi"))
+			if err != nil {
+				return err
+			}
+
+			err = conn.(interface{ CloseWrite() error }).CloseWrite()
+			if err != nil {
+				return err
+			}
+
+			// the client keeps on writing
+			b, err := io.ReadAll(conn)
+			received <- string(b)
+
+			return err
+		}), WithServerMuxers(H2(time.Second)))
+
+		c := NewClient(listen(t, srv), WithClientMuxer(H2(time.Second)))
+		defer c.Close()
+
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(b))
+
+		_, err = conn.Write([]byte("there"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+		assert.Equal(t, "there", <-received)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		received := make(chan error, 1)
 
-	c.Close()
+		srv := NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			nconn := conn.(net.Conn)
 
-	wg.Wait()
+			require.NoError(t, nconn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+			_, err := nconn.Read(make([]byte, 1))
+			received <- err
+
+			// keep the stream open for the client deadline
+			<-ctx.Done()
+
+			return nil
+		}), WithServerMuxers(H2(time.Second)))
+
+		c := NewClient(listen(t, srv), WithClientMuxer(H2(time.Second)))
+		defer c.Close()
+
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.ErrorIs(t, <-received, os.ErrDeadlineExceeded)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestStats(t *testing.T) {
+	toWrite := "hello"
+
+	var reportsm sync.Mutex
+	var reports []SessionStats
+
+	opener := listen(t, NewServer(echo(t, toWrite), WithServerStats(10*time.Millisecond, func(ctx context.Context, stats SessionStats) {
+		reportsm.Lock()
+		defer reportsm.Unlock()
+
+		reports = append(reports, stats)
+	})))
+
+	var connsm sync.Mutex
+	var conns []net.Conn
+
+	c := NewClient(tuntuntun.OpenerFunc(func(ctx context.Context) (net.Conn, error) {
+		conn, err := opener.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		connsm.Lock()
+		conns = append(conns, conn)
+		connsm.Unlock()
+
+		return conn, nil
+	}), WithClientBackoff(time.Millisecond, time.Millisecond))
+	defer c.Close()
+
+	for range 2 {
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+
+		roundtrip(t, conn, toWrite)
+		conn.Close()
+	}
+
+	require.Eventually(t, func() bool {
+		stats := c.Stats()
+
+		return len(stats.Sessions) == 1 && stats.Sessions[0].RTT > 0
+	}, time.Second, 10*time.Millisecond)
+
+	stats := c.Stats()
+	assert.Equal(t, StateUp, stats.State)
+	assert.Zero(t, stats.Reconnects)
+	assert.EqualValues(t, 2, stats.Sessions[0].TotalStreams)
+	assert.NotZero(t, stats.Sessions[0].BytesIn)
+	assert.NotZero(t, stats.Sessions[0].BytesOut)
+	assert.Positive(t, stats.Sessions[0].Age)
+
+	require.Eventually(t, func() bool {
+		reportsm.Lock()
+		defer reportsm.Unlock()
+
+		return len(reports) > 0 && reports[len(reports)-1].TotalStreams == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// lose the session, the next Open reconnects
+	connsm.Lock()
+	conns[0].Close()
+	connsm.Unlock()
+
+	require.Eventually(t, func() bool {
+		return c.State() == StateDown
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, toWrite)
+
+	stats = c.Stats()
+	assert.EqualValues(t, 1, stats.Reconnects)
+	require.Len(t, stats.Sessions, 1)
+	assert.EqualValues(t, 1, stats.Sessions[0].TotalStreams)
+}
+
+func TestStatsDefaultInterval(t *testing.T) {
+	toWrite := "hello"
+
+	reports := make(chan SessionStats, 1)
+
+	opener := listen(t, NewServer(echo(t, toWrite), WithServerStats(0, func(ctx context.Context, stats SessionStats) {
+		reports <- stats
+	})))
+
+	c := NewClient(opener)
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+
+	roundtrip(t, conn, toWrite)
+	conn.Close()
+
+	require.NoError(t, c.Close())
+
+	select {
+	case stats := <-reports:
+		assert.EqualValues(t, 1, stats.TotalStreams)
+	case <-time.After(time.Second):
+		t.Fatal("no stats reported when the session ended")
+	}
 }
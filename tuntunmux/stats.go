@@ -0,0 +1,87 @@
+package tuntunmux
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rttInterval is how often the round trip time of a session is measured.
+const rttInterval = 30 * time.Second
+
+// SessionStats is a snapshot of the activity of a session.
+type SessionStats struct {
+	ActiveStreams int
+	// TotalStreams counts the streams opened since the session started.
+	TotalStreams uint64
+	BytesIn      uint64
+	BytesOut     uint64
+	// RTT is the last measured keepalive round trip time, zero until measured
+	// or when the muxer does not support pings. A Client only starts measuring
+	// it on the first call to Stats.
+	RTT time.Duration
+	Age time.Duration
+}
+
+// ClientStats is a snapshot of the activity of a Client.
+type ClientStats struct {
+	State State
+	// Sessions includes the sessions draining after a GoAway.
+	Sessions []SessionStats
+	// Reconnects counts the sessions established to replace one that ended.
+	Reconnects uint64
+}
+
+// sessionStats tracks what the muxers do not report themselves.
+type sessionStats struct {
+	created time.Time
+	streams atomic.Uint64
+	rtt     atomic.Int64
+	rttOnce sync.Once
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{created: time.Now()}
+}
+
+func (st *sessionStats) snapshot(active int, conn *countingConn) SessionStats {
+	return SessionStats{
+		ActiveStreams: active,
+		TotalStreams:  st.streams.Load(),
+		BytesIn:       conn.read.Load(),
+		BytesOut:      conn.written.Load(),
+		RTT:           time.Duration(st.rtt.Load()),
+		Age:           time.Since(st.created),
+	}
+}
+
+// startRTT starts tracking the round trip time of sess, once.
+func (st *sessionStats) startRTT(sess Session) {
+	st.rttOnce.Do(func() {
+		go st.trackRTT(sess)
+	})
+}
+
+// trackRTT measures the round trip time of sess every rttInterval, until it is
+// closed.
+func (st *sessionStats) trackRTT(sess Session) {
+	t := time.NewTicker(rttInterval)
+	defer t.Stop()
+
+	for {
+		rtt, err := sess.Ping()
+		if errors.Is(err, errors.ErrUnsupported) {
+			return
+		}
+		if err == nil {
+			st.rtt.Store(int64(rtt))
+		}
+
+		select {
+		case <-t.C:
+		case <-sess.CloseChan():
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package tuntunquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+type ClientOption func(c *Client)
+
+// WithTLSConfig sets the TLS configuration used to reach the server, it is
+// cloned and completed with the ALPN protocol and a session cache enabling 0-RTT
+// reconnects.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithClientConfig sets the QUIC configuration of the conns to the server, by
+// default keep-alives are sent every 15s so that idle conns are not lost.
+func WithClientConfig(cfg *quic.Config) ClientOption {
+	return func(c *Client) {
+		c.config = cfg
+	}
+}
+
+// NewClient returns a client opening streams of a single QUIC conn to the
+// server at the UDP address addr, the conn is dialed again once lost.
+func NewClient(addr string, opts ...ClientOption) *Client {
+	c := &Client{
+		addr: addr,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.config == nil {
+		c.config = &quic.Config{KeepAlivePeriod: 15 * time.Second}
+	}
+	if c.tlsConfig == nil {
+		c.tlsConfig = &tls.Config{}
+	}
+	if !slices.Contains(c.tlsConfig.NextProtos, ALPN) {
+		c.tlsConfig.NextProtos = append(c.tlsConfig.NextProtos, ALPN)
+	}
+	if c.tlsConfig.ClientSessionCache == nil {
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	return c
+}
+
+type Client struct {
+	addr      string
+	tlsConfig *tls.Config
+	config    *quic.Config
+
+	mu   sync.Mutex
+	conn *quic.Conn
+	dial *dialCall
+}
+
+// dialCall is a dial in flight, shared by concurrent Opens.
+type dialCall struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
+}
+
+// session returns the QUIC conn to the server, dialing it if needed. 0-RTT is
+// attempted when resuming a previous session.
+func (c *Client) session(ctx context.Context) (*quic.Conn, error) {
+	for {
+		c.mu.Lock()
+
+		if c.conn != nil && c.conn.Context().Err() == nil {
+			conn := c.conn
+			c.mu.Unlock()
+
+			return conn, nil
+		}
+
+		if d := c.dial; d != nil {
+			c.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-d.done:
+			}
+
+			if errors.Is(d.err, context.Canceled) || errors.Is(d.err, context.DeadlineExceeded) {
+				// the dialing Open gave up, try again with our own context
+				continue
+			}
+
+			return d.conn, d.err
+		}
+
+		d := &dialCall{done: make(chan struct{})}
+		c.dial = d
+		c.mu.Unlock()
+
+		d.conn, d.err = quic.DialAddrEarly(ctx, c.addr, c.tlsConfig, c.config)
+
+		c.mu.Lock()
+		c.dial = nil
+		if d.err == nil {
+			c.conn = d.conn
+		}
+		c.mu.Unlock()
+		close(d.done)
+
+		return d.conn, d.err
+	}
+}
+
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := conn.OpenStreamSync(ctx)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// the streams opened in 0-RTT are lost, the conn goes on in 1-RTT
+			err = c.next(ctx, conn)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			// the conn was lost since it was last used
+			if attempt == 0 && ctx.Err() == nil && conn.Context().Err() != nil {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return newConn(stream, conn), nil
+	}
+}
+
+// next replaces conn, after the server rejected its 0-RTT data.
+func (c *Client) next(ctx context.Context, conn *quic.Conn) error {
+	next, err := conn.NextConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn {
+		c.conn = next
+	}
+
+	return nil
+}
+
+// Close closes the QUIC conn, and with it every stream opened by the client.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.CloseWithError(0, "")
+}
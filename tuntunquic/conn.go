@@ -0,0 +1,55 @@
+package tuntunquic
+
+import (
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the protocol negotiated by clients and servers.
+const ALPN = "tuntun"
+
+// abortCode resets the stream of a handler that failed, so that the client does
+// not mistake it for a clean end of stream.
+const abortCode quic.StreamErrorCode = 1
+
+// Conn is a net.Conn carried by a QUIC stream.
+type Conn struct {
+	*quic.Stream
+	laddr net.Addr
+	raddr net.Addr
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(stream *quic.Stream, conn *quic.Conn) *Conn {
+	return &Conn{
+		Stream: stream,
+		laddr:  conn.LocalAddr(),
+		raddr:  conn.RemoteAddr(),
+	}
+}
+
+// CloseWrite ends the stream, which can still be read.
+func (c *Conn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *Conn) Close() error {
+	c.Stream.CancelRead(0)
+
+	return c.Stream.Close()
+}
+
+func (c *Conn) abort() {
+	c.Stream.CancelRead(abortCode)
+	c.Stream.CancelWrite(abortCode)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
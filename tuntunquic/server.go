@@ -0,0 +1,160 @@
+package tuntunquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"tuntuntun"
+
+	"github.com/quic-go/quic-go"
+)
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithConfig sets the QUIC configuration of the listener created by
+// ListenAndServe.
+func WithConfig(cfg *quic.Config) Option {
+	return func(s *Server) {
+		s.config = cfg
+	}
+}
+
+// WithAllow0RTT accepts streams sent by resuming clients before the end of the
+// handshake. Such data may be replayed by an attacker, handlers must tolerate
+// it. Resuming across restarts requires stable session ticket keys, see
+// tls.Config.SetSessionTicketKeys.
+func WithAllow0RTT() Option {
+	return func(s *Server) {
+		s.allow0RTT = true
+	}
+}
+
+// Server serves every stream of the QUIC conns it accepts as a conn. The server
+// follows clients whose address changes, e.g. after a NAT rebinding.
+type Server struct {
+	handler   tuntuntun.Handler
+	logger    *slog.Logger
+	config    *quic.Config
+	allow0RTT bool
+}
+
+func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
+	s := &Server{
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Listen listens on the UDP address addr, the ALPN protocol is added to the
+// TLS configuration.
+func (s *Server) Listen(addr string, tlsConfig *tls.Config) (*quic.EarlyListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	if !slices.Contains(tlsConfig.NextProtos, ALPN) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, ALPN)
+	}
+
+	cfg := &quic.Config{}
+	if s.config != nil {
+		cfg = s.config.Clone()
+	}
+	cfg.Allow0RTT = s.allow0RTT
+
+	return quic.ListenAddrEarly(addr, tlsConfig, cfg)
+}
+
+func (s *Server) ListenAndServe(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	ln, err := s.Listen(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts conns from ln until ctx is cancelled, it then closes ln and the
+// conns, and returns once their handlers returned.
+func (s *Server) Serve(ctx context.Context, ln *quic.EarlyListener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveQUIC(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveQUIC(ctx context.Context, conn *quic.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(conn.Context(), cancel)
+	defer stop()
+
+	defer conn.CloseWithError(0, "")
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			var appErr *quic.ApplicationError
+			if ctx.Err() == nil && !errors.As(err, &appErr) && s.logger != nil {
+				s.logger.Log(ctx, slog.LevelError, "quic: failed to accept stream", slog.String("err", err.Error()))
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveStream(ctx, newConn(stream, conn))
+		}()
+	}
+}
+
+func (s *Server) serveStream(ctx context.Context, conn *Conn) {
+	err := s.handler.ServeConn(ctx, conn)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelError, "quic: failed to serve", slog.String("err", err.Error()))
+		}
+
+		conn.abort()
+		return
+	}
+
+	_ = conn.Close()
+}
@@ -0,0 +1,330 @@
+package tuntunquic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"tuntuntun"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(t *testing.T, expected string) tuntuntun.HandlerFunc {
+	return func(ctx context.Context, conn io.ReadWriteCloser) error {
+		defer conn.Close()
+
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("said: " + string(buf)))
+
+		return err
+	}
+}
+
+func roundtrip(t *testing.T, conn net.Conn, sent string) {
+	expected := "said: " + sent
+
+	go func() {
+		_, _ = conn.Write([]byte(sent))
+	}()
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, string(buf))
+}
+
+// selfSigned returns a server TLS configuration for localhost, and a client one
+// trusting it.
+func selfSigned(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, &tls.Config{
+		RootCAs: pool,
+	}
+}
+
+// serve serves h on a loopback UDP port until the test ends.
+func serve(t *testing.T, addr string, serverTLS *tls.Config, h tuntuntun.Handler, opts ...Option) string {
+	s := NewServer(h, opts...)
+
+	ln, err := s.Listen(addr, serverTLS)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return ln.Addr().String()
+}
+
+func TestSanity(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	addr := serve(t, "127.0.0.1:0", serverTLS, echo(t, "hello"))
+
+	c := NewClient(addr, WithTLSConfig(clientTLS))
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, "hello")
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	assert.Equal(t, addr, conn.RemoteAddr().String())
+}
+
+func TestStress(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	addr := serve(t, "127.0.0.1:0", serverTLS, echo(t, "hello"))
+
+	c := NewClient(addr, WithTLSConfig(clientTLS))
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 100 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+}
+
+func TestHalfClose(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	addr := serve(t, "127.0.0.1:0", serverTLS, tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write(b)
+
+		return err
+	}))
+
+	c := NewClient(addr, WithTLSConfig(clientTLS))
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.(*Conn).CloseWrite())
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestServerAbort(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	addr := serve(t, "127.0.0.1:0", serverTLS, tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := conn.Write([]byte("partial"))
+		if err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	}))
+
+	c := NewClient(addr, WithTLSConfig(clientTLS))
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(conn)
+
+	var serr *quic.StreamError
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, abortCode, serr.ErrorCode)
+}
+
+func TestReconnect(t *testing.T) {
+	for _, allow0RTT := range []bool{true, false} {
+		t.Run(fmt.Sprint("0rtt=", allow0RTT), func(t *testing.T) {
+			serverTLS, clientTLS := selfSigned(t)
+			// sessions are resumed across restarts
+			serverTLS.SetSessionTicketKeys([][32]byte{{1}})
+
+			h := echo(t, "hello")
+
+			var opts []Option
+			if allow0RTT {
+				opts = append(opts, WithAllow0RTT())
+			}
+
+			ln, err := NewServer(h, opts...).Listen("127.0.0.1:0", serverTLS)
+			require.NoError(t, err)
+			addr := ln.Addr().String()
+
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan error)
+			go func() {
+				done <- NewServer(h, opts...).Serve(ctx, ln)
+			}()
+
+			c := NewClient(addr, WithTLSConfig(clientTLS))
+			defer c.Close()
+
+			conn, err := c.Open(t.Context())
+			require.NoError(t, err)
+			roundtrip(t, conn, "hello")
+			conn.Close()
+
+			// the server restarts, closing the QUIC conn
+			cancel()
+			require.NoError(t, <-done)
+
+			// the socket is released once the QUIC conns are gone
+			require.Eventually(t, func() bool {
+				ln, err = NewServer(h, opts...).Listen(addr, serverTLS)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+
+			ctx, cancel = context.WithCancel(t.Context())
+			go func() {
+				done <- NewServer(h, opts...).Serve(ctx, ln)
+			}()
+			defer func() {
+				cancel()
+				require.NoError(t, <-done)
+			}()
+
+			require.Eventually(t, func() bool {
+				conn, err := c.Open(t.Context())
+				if err != nil {
+					return false
+				}
+				defer conn.Close()
+
+				_, err = conn.Write([]byte("hello"))
+				if err != nil {
+					return false
+				}
+
+				b, err := io.ReadAll(conn)
+
+				return err == nil && string(b) == "said: hello"
+			}, 5*time.Second, 10*time.Millisecond)
+
+			c.mu.Lock()
+			state := c.conn.ConnectionState()
+			c.mu.Unlock()
+
+			assert.True(t, state.TLS.DidResume)
+			assert.Equal(t, allow0RTT, state.Used0RTT)
+		})
+	}
+}
+
+func TestConcurrentDial(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	var mu sync.Mutex
+	raddrs := map[string]bool{}
+
+	addr := serve(t, "127.0.0.1:0", serverTLS, tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		mu.Lock()
+		raddrs[conn.(net.Conn).RemoteAddr().String()] = true
+		mu.Unlock()
+
+		return echo(t, "hello")(ctx, conn)
+	}))
+
+	c := NewClient(addr, WithTLSConfig(clientTLS))
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 10 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	// the concurrent Opens shared a single QUIC conn
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, raddrs, 1)
+}
@@ -0,0 +1,273 @@
+package tuntunrate
+
+import (
+	"context"
+	"io"
+	"sync"
+	"tuntuntun"
+
+	"golang.org/x/time/rate"
+)
+
+const DefaultBurst = 32 * 1024
+
+// Limit is a pair of rates in bytes per second, zero means unlimited.
+// Up applies to bytes read from the wrapped conn, Down to bytes written to it.
+type Limit struct {
+	Up   int
+	Down int
+}
+
+type Option func(l *Limiter)
+
+// WithGlobal limits the sum of all conns wrapped by the Limiter.
+func WithGlobal(up, down int) Option {
+	return func(l *Limiter) {
+		l.global = Limit{Up: up, Down: down}
+	}
+}
+
+// WithPerPeer limits the sum of all conns wrapped for the same peer.
+func WithPerPeer(up, down int) Option {
+	return func(l *Limiter) {
+		l.perPeer = Limit{Up: up, Down: down}
+	}
+}
+
+// WithPerConn limits every wrapped conn individually.
+func WithPerConn(up, down int) Option {
+	return func(l *Limiter) {
+		l.perConn = Limit{Up: up, Down: down}
+	}
+}
+
+// WithBurst sets the token bucket size, which is also the largest chunk read or
+// written in one go.
+func WithBurst(n int) Option {
+	return func(l *Limiter) {
+		if n > 0 {
+			l.burst = n
+		}
+	}
+}
+
+// WithPeerKey sets how Handler identifies the peer of a conn, conns with an empty
+// key are not subject to per-peer limits.
+func WithPeerKey(f func(ctx context.Context) string) Option {
+	return func(l *Limiter) {
+		l.peerKey = f
+	}
+}
+
+type buckets struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func newBuckets(l Limit, burst int) buckets {
+	var b buckets
+	if l.Up > 0 {
+		b.up = rate.NewLimiter(rate.Limit(l.Up), burst)
+	}
+	if l.Down > 0 {
+		b.down = rate.NewLimiter(rate.Limit(l.Down), burst)
+	}
+
+	return b
+}
+
+type peerBuckets struct {
+	buckets
+	refs int
+}
+
+// Limiter is a set of token buckets shared by the conns it wraps.
+type Limiter struct {
+	global  Limit
+	perPeer Limit
+	perConn Limit
+	burst   int
+	peerKey func(ctx context.Context) string
+
+	globalBuckets buckets
+
+	mu    sync.Mutex
+	peers map[string]*peerBuckets
+}
+
+func NewLimiter(opts ...Option) *Limiter {
+	l := &Limiter{
+		burst: DefaultBurst,
+		peers: map[string]*peerBuckets{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	l.globalBuckets = newBuckets(l.global, l.burst)
+
+	return l
+}
+
+func (l *Limiter) acquirePeer(peer string) buckets {
+	if peer == "" || (l.perPeer.Up <= 0 && l.perPeer.Down <= 0) {
+		return buckets{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.peers[peer]
+	if !ok {
+		p = &peerBuckets{buckets: newBuckets(l.perPeer, l.burst)}
+		l.peers[peer] = p
+	}
+	p.refs++
+
+	return p.buckets
+}
+
+func (l *Limiter) releasePeer(peer string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.peers[peer]
+	if !ok {
+		return
+	}
+
+	p.refs--
+	if p.refs <= 0 {
+		delete(l.peers, peer)
+	}
+}
+
+// Wrap returns conn throttled by the global, per-peer and per-conn limits.
+// Waits are aborted when ctx is done, the peer is released on Close.
+func (l *Limiter) Wrap(ctx context.Context, peer string, conn io.ReadWriteCloser) *Conn {
+	peerBuckets := l.acquirePeer(peer)
+	connBuckets := newBuckets(l.perConn, l.burst)
+
+	c := &Conn{
+		ReadWriteCloser: conn,
+		ctx:             ctx,
+		burst:           l.burst,
+		release: func() {
+			if peerBuckets != (buckets{}) {
+				l.releasePeer(peer)
+			}
+		},
+	}
+
+	for _, b := range []buckets{connBuckets, peerBuckets, l.globalBuckets} {
+		if b.up != nil {
+			c.up = append(c.up, b.up)
+		}
+		if b.down != nil {
+			c.down = append(c.down, b.down)
+		}
+	}
+
+	return c
+}
+
+// Handler is a middleware throttling every conn served by next.
+func (l *Limiter) Handler(next tuntuntun.Handler) tuntuntun.Handler {
+	return tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		var peer string
+		if l.peerKey != nil {
+			peer = l.peerKey(ctx)
+		}
+
+		c := l.Wrap(ctx, peer, conn)
+		defer c.done()
+
+		return next.ServeConn(ctx, c)
+	})
+}
+
+type Conn struct {
+	io.ReadWriteCloser
+
+	ctx   context.Context
+	burst int
+	up    []*rate.Limiter
+	down  []*rate.Limiter
+
+	releaseOnce sync.Once
+	release     func()
+}
+
+func wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.up) > 0 && len(p) > c.burst {
+		p = p[:c.burst]
+	}
+
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		werr := wait(c.ctx, c.up, n)
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(c.down) == 0 {
+		return c.ReadWriteCloser.Write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.burst {
+			chunk = chunk[:c.burst]
+		}
+
+		err := wait(c.ctx, c.down, len(chunk))
+		if err != nil {
+			return written, err
+		}
+
+		n, err := c.ReadWriteCloser.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+func (c *Conn) done() {
+	c.releaseOnce.Do(c.release)
+}
+
+func (c *Conn) Close() error {
+	c.done()
+
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,74 @@
+package tuntunrate
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"tuntuntun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerConnDown(t *testing.T) {
+	l := NewLimiter(WithPerConn(0, 10_000), WithBurst(1_000))
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := l.Wrap(t.Context(), "", c1)
+	defer c.Close()
+
+	go func() {
+		_, _ = c.Write(make([]byte, 5_000))
+		c.Close()
+	}()
+
+	start := time.Now()
+	b, err := io.ReadAll(c2)
+	require.NoError(t, err)
+
+	assert.Len(t, b, 5_000)
+	// the first 1_000 bytes are the initial burst
+	assert.GreaterOrEqual(t, time.Since(start), 350*time.Millisecond)
+}
+
+func TestPeerShared(t *testing.T) {
+	l := NewLimiter(
+		WithPerPeer(10_000, 0),
+		WithBurst(1_000),
+		WithPeerKey(func(ctx context.Context) string {
+			return "peer"
+		}),
+	)
+
+	h := l.Handler(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := io.Copy(io.Discard, conn)
+		return err
+	}))
+
+	start := time.Now()
+
+	done := make(chan error, 2)
+	for range 2 {
+		c1, c2 := net.Pipe()
+
+		go func() {
+			done <- h.ServeConn(t.Context(), c1)
+		}()
+
+		go func() {
+			_, _ = c2.Write(make([]byte, 3_000))
+			c2.Close()
+		}()
+	}
+
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+
+	// 6_000 bytes on a shared 10_000 B/s bucket with a 1_000 bytes burst
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Empty(t, l.peers)
+}
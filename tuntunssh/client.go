@@ -0,0 +1,249 @@
+package tuntunssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DefaultKeepAliveInterval = 30 * time.Second
+	DefaultKeepAliveTimeout  = 15 * time.Second
+)
+
+// keepAliveRequest is the global request sent to check that the server is
+// alive, servers answer it even when they do not support it.
+const keepAliveRequest = "keepalive@openssh.com"
+
+type ClientOption func(c *Client)
+
+// WithDialer sets the dialer of the TCP conns.
+func WithDialer(d *net.Dialer) ClientOption {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithKeepAlive sets how often the client sends a keepalive request to the
+// server and how long it waits for the reply before closing the SSH conn, zero
+// disables keepalives. Defaults to DefaultKeepAliveInterval and
+// DefaultKeepAliveTimeout.
+func WithKeepAlive(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.keepAliveInterval = interval
+		c.keepAliveTimeout = timeout
+	}
+}
+
+// NewClient returns a client opening channels of a single SSH conn to the server
+// at the TCP address addr, the conn is dialed again once lost. The config holds
+// the user, its keys and the host key verification, e.g. ssh.PublicKeys and
+// ssh.FixedHostKey.
+func NewClient(addr string, config *ssh.ClientConfig, opts ...ClientOption) *Client {
+	c := &Client{
+		addr:              addr,
+		config:            config,
+		dialer:            &net.Dialer{},
+		keepAliveInterval: DefaultKeepAliveInterval,
+		keepAliveTimeout:  DefaultKeepAliveTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type Client struct {
+	addr              string
+	config            *ssh.ClientConfig
+	dialer            *net.Dialer
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+	dial   *dialCall
+}
+
+// dialCall is a dial in flight, shared by concurrent Opens.
+type dialCall struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// session returns the SSH conn to the server, dialing it if needed.
+func (c *Client) session(ctx context.Context) (*ssh.Client, error) {
+	for {
+		c.mu.Lock()
+
+		if c.client != nil {
+			client := c.client
+			c.mu.Unlock()
+
+			return client, nil
+		}
+
+		if d := c.dial; d != nil {
+			c.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-d.done:
+			}
+
+			if errors.Is(d.err, context.Canceled) || errors.Is(d.err, context.DeadlineExceeded) {
+				// the dialing Open gave up, try again with our own context
+				continue
+			}
+
+			return d.client, d.err
+		}
+
+		d := &dialCall{done: make(chan struct{})}
+		c.dial = d
+		c.mu.Unlock()
+
+		d.client, d.err = c.connect(ctx)
+
+		c.mu.Lock()
+		c.dial = nil
+		if d.err == nil {
+			c.client = d.client
+		}
+		c.mu.Unlock()
+		close(d.done)
+
+		if d.err == nil {
+			go c.watch(d.client)
+		}
+
+		return d.client, d.err
+	}
+}
+
+// connect dials the SSH conn to the server.
+func (c *Client) connect(ctx context.Context) (*ssh.Client, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bound by ctx, the conn is not
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, c.addr, c.config)
+	if !stop() {
+		if err == nil {
+			_ = sconn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sconn, chans, reqs), nil
+}
+
+// watch keeps client alive until it is closed, and forgets it then.
+func (c *Client) watch(client *ssh.Client) {
+	if c.keepAliveInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go c.keepAlive(ctx, client)
+	}
+
+	_ = client.Wait()
+
+	c.mu.Lock()
+	if c.client == client {
+		c.client = nil
+	}
+	c.mu.Unlock()
+}
+
+// keepAlive sends a keepalive request every interval until ctx is done, and
+// closes client when the server does not reply in time.
+func (c *Client) keepAlive(ctx context.Context, client *ssh.Client) {
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			// the server declining the request still proves it alive
+			_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+			replied <- err
+		}()
+
+		if !c.awaitKeepAlive(ctx, replied) {
+			break
+		}
+	}
+
+	_ = client.Close()
+}
+
+// awaitKeepAlive reports whether the server replied to a keepalive request
+// in time, or ctx is done.
+func (c *Client) awaitKeepAlive(ctx context.Context, replied <-chan error) bool {
+	var timeout <-chan time.Time
+	if c.keepAliveTimeout > 0 {
+		t := time.NewTimer(c.keepAliveTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return true
+	case err := <-replied:
+		return err == nil
+	case <-timeout:
+		return false
+	}
+}
+
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	client, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, reqs, err := client.OpenChannel(ChannelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return newConn(ch, client), nil
+}
+
+// Close closes the SSH conn, and with it every channel opened by the client.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+
+	return c.client.Close()
+}
@@ -0,0 +1,96 @@
+package tuntunssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+	"tuntuntun/internal/pipeconn"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ChannelType is the type of the SSH channels carrying conns.
+const ChannelType = "tuntun"
+
+// closeTimeout bounds how long Close waits for the written data to be sent.
+const closeTimeout = 5 * time.Second
+
+// Conn is a net.Conn carried by an SSH channel. Reads and writes go through
+// pipes pumped from and to the channel, so that a deadline only interrupts the
+// pending calls in its direction and can be extended once passed.
+type Conn struct {
+	ch ssh.Channel
+	r  *pipeconn.PipeReader
+	w  *pipeconn.PipeWriter
+
+	laddr net.Addr
+	raddr net.Addr
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(ch ssh.Channel, conn ssh.Conn) *Conn {
+	return &Conn{
+		ch:    ch,
+		r:     pipeconn.NewPipeReader(ch),
+		w:     pipeconn.NewPipeWriter(ch),
+		laddr: conn.LocalAddr(),
+		raddr: conn.RemoteAddr(),
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	err1 := c.SetReadDeadline(t)
+	err2 := c.SetWriteDeadline(t)
+
+	return errors.Join(err1, err2)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *Conn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+func (c *Conn) Write(data []byte) (int, error) {
+	return c.w.Write(data)
+}
+
+// CloseWrite sends EOF to the peer, which can keep on writing.
+func (c *Conn) CloseWrite() error {
+	return c.w.CloseWrite()
+}
+
+// Close waits for the written data to be sent, up to closeTimeout, and closes
+// the channel.
+func (c *Conn) Close() error {
+	t := time.AfterFunc(closeTimeout, func() {
+		_ = c.ch.Close()
+	})
+	defer t.Stop()
+
+	c.w.Flush()
+
+	// closing an already closed channel fails with io.EOF
+	err := c.r.Close()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,238 @@
+package tuntunssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+	"tuntuntun"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultHandshakeTimeout bounds how long the server waits for a client to
+// complete the SSH handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithAuthorizedKeys authenticates the clients presenting one of keys.
+func WithAuthorizedKeys(keys ...ssh.PublicKey) Option {
+	return func(s *Server) {
+		s.authorizedKeys = append(s.authorizedKeys, keys...)
+	}
+}
+
+// WithPublicKeyCallback authenticates clients with f, as in
+// ssh.ServerConfig.PublicKeyCallback, instead of a list of authorized keys.
+func WithPublicKeyCallback(f func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)) Option {
+	return func(s *Server) {
+		s.publicKeyCallback = f
+	}
+}
+
+// WithServerConfig registers a function tuning the SSH configuration, e.g. its
+// algorithms or banner.
+func WithServerConfig(f func(cfg *ssh.ServerConfig)) Option {
+	return func(s *Server) {
+		s.configFuncs = append(s.configFuncs, f)
+	}
+}
+
+// WithHandshakeTimeout sets how long a client may take to complete the SSH
+// handshake, authentication included, DefaultHandshakeTimeout by default.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		if d > 0 {
+			s.handshakeTimeout = d
+		}
+	}
+}
+
+// Server is an SSH server handing every channel of type ChannelType to its
+// handler, clients authenticate with public keys.
+type Server struct {
+	handler           tuntuntun.Handler
+	logger            *slog.Logger
+	authorizedKeys    []ssh.PublicKey
+	publicKeyCallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+	configFuncs       []func(cfg *ssh.ServerConfig)
+	handshakeTimeout  time.Duration
+
+	config *ssh.ServerConfig
+}
+
+// NewServer returns a server identified by hostKey.
+func NewServer(handler tuntuntun.Handler, hostKey ssh.Signer, opts ...Option) *Server {
+	s := &Server{
+		handler:          handler,
+		handshakeTimeout: DefaultHandshakeTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: s.publicKeyCallback,
+	}
+	if s.config.PublicKeyCallback == nil {
+		s.config.PublicKeyCallback = s.authorize
+	}
+	s.config.AddHostKey(hostKey)
+
+	for _, f := range s.configFuncs {
+		f(s.config)
+	}
+
+	return s
+}
+
+// fingerprintExtension holds the fingerprint of the key a client authenticated
+// with, in the permissions of its conn.
+const fingerprintExtension = "pubkey-fp"
+
+func (s *Server) authorize(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	b := key.Marshal()
+	for _, k := range s.authorizedKeys {
+		if bytes.Equal(k.Marshal(), b) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{fingerprintExtension: ssh.FingerprintSHA256(key)},
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("ssh: unknown public key for %q", conn.User())
+}
+
+type serverConnKey struct{}
+
+// ServerConnFromContext returns the SSH conn of a served channel, e.g. to read
+// its user or permissions.
+func ServerConnFromContext(ctx context.Context) *ssh.ServerConn {
+	conn, _ := ctx.Value(serverConnKey{}).(*ssh.ServerConn)
+
+	return conn
+}
+
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts SSH conns from l until ctx is cancelled or l is closed, it then
+// closes l and returns once the handlers returned.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = l.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveSSH(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveSSH(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// the conn does not outlive the server
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelWarn, "ssh: failed handshake", slog.String("err", err.Error()))
+		}
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	ctx = context.WithValue(ctx, serverConnKey{}, sconn)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != ChannelType {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Log(ctx, slog.LevelError, "ssh: failed to accept channel", slog.String("err", err.Error()))
+			}
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveChannel(ctx, newConn(ch, sconn))
+		}()
+	}
+}
+
+func (s *Server) serveChannel(ctx context.Context, conn *Conn) {
+	defer conn.Close()
+
+	err := s.handler.ServeConn(ctx, conn)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelError, "ssh: failed to serve", slog.String("err", err.Error()))
+		}
+		return
+	}
+}
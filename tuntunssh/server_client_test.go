@@ -0,0 +1,440 @@
+package tuntunssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"tuntuntun"
+	"tuntuntun/tuntunmux"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(t *testing.T, expected string) tuntuntun.HandlerFunc {
+	return func(ctx context.Context, conn io.ReadWriteCloser) error {
+		defer conn.Close()
+
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("said: " + string(buf)))
+
+		return err
+	}
+}
+
+func roundtrip(t *testing.T, conn net.Conn, sent string) {
+	expected := "said: " + sent
+
+	go func() {
+		_, _ = conn.Write([]byte(sent))
+	}()
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, string(buf))
+}
+
+func signer(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	s, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	return s
+}
+
+// serve serves srv on l until the test ends.
+func serve(t *testing.T, srv *Server, l net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+type keys struct {
+	host   ssh.Signer
+	client ssh.Signer
+}
+
+func newKeys(t *testing.T) keys {
+	return keys{host: signer(t), client: signer(t)}
+}
+
+func (k keys) server(h tuntuntun.Handler) *Server {
+	return NewServer(h, k.host, WithAuthorizedKeys(k.client.PublicKey()))
+}
+
+func (k keys) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "agent",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(k.client)},
+		HostKeyCallback: ssh.FixedHostKey(k.host.PublicKey()),
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return l
+}
+
+func TestSanity(t *testing.T) {
+	k := newKeys(t)
+
+	var user, fingerprint string
+	l := listen(t)
+	serve(t, k.server(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		sconn := ServerConnFromContext(ctx)
+		user = sconn.User()
+		fingerprint = sconn.Permissions.Extensions[fingerprintExtension]
+
+		return echo(t, "hello")(ctx, conn)
+	})), l)
+
+	c := NewClient(l.Addr().String(), k.clientConfig())
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, "hello")
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	assert.Equal(t, "agent", user)
+	assert.Equal(t, ssh.FingerprintSHA256(k.client.PublicKey()), fingerprint)
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+}
+
+func TestStress(t *testing.T) {
+	k := newKeys(t)
+
+	l := listen(t)
+	serve(t, k.server(echo(t, "hello")), l)
+
+	c := NewClient(l.Addr().String(), k.clientConfig())
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 100 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+}
+
+func TestAuth(t *testing.T) {
+	k := newKeys(t)
+
+	l := listen(t)
+	serve(t, k.server(echo(t, "hello")), l)
+
+	t.Run("unknown key", func(t *testing.T) {
+		cfg := k.clientConfig()
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer(t))}
+
+		_, err := NewClient(l.Addr().String(), cfg).Open(t.Context())
+		require.ErrorContains(t, err, "unable to authenticate")
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		cfg := k.clientConfig()
+		cfg.HostKeyCallback = ssh.FixedHostKey(signer(t).PublicKey())
+
+		_, err := NewClient(l.Addr().String(), cfg).Open(t.Context())
+		require.ErrorContains(t, err, "host key mismatch")
+	})
+
+	t.Run("unknown channel type", func(t *testing.T) {
+		client, err := ssh.Dial("tcp", l.Addr().String(), k.clientConfig())
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.NewSession()
+
+		var oerr *ssh.OpenChannelError
+		require.ErrorAs(t, err, &oerr)
+		assert.Equal(t, ssh.UnknownChannelType, oerr.Reason)
+	})
+}
+
+func TestReconnect(t *testing.T) {
+	k := newKeys(t)
+
+	l := listen(t)
+	addr := l.Addr().String()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		done <- k.server(echo(t, "hello")).Serve(ctx, l)
+	}()
+
+	c := NewClient(addr, k.clientConfig())
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	roundtrip(t, conn, "hello")
+	conn.Close()
+
+	// the server restarts, closing the SSH conn
+	cancel()
+	require.NoError(t, <-done)
+
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	serve(t, k.server(echo(t, "hello")), l)
+
+	require.Eventually(t, func() bool {
+		conn, err := c.Open(t.Context())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+
+		roundtrip(t, conn, "hello")
+
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMux(t *testing.T) {
+	k := newKeys(t)
+
+	l := listen(t)
+	serve(t, k.server(tuntunmux.NewServer(echo(t, "hello"))), l)
+
+	c := tuntunmux.NewClient(NewClient(l.Addr().String(), k.clientConfig()))
+	defer c.Close()
+
+	for range 10 {
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+
+		roundtrip(t, conn, "hello")
+		conn.Close()
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	k := newKeys(t)
+
+	serverErr := make(chan error, 1)
+
+	l := listen(t)
+	serve(t, k.server(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		c := conn.(net.Conn)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+		_, err := c.Read(make([]byte, 1))
+		serverErr <- err
+
+		// the channel outlives the deadline once it is extended
+		require.NoError(t, c.SetReadDeadline(time.Time{}))
+
+		_, err = io.Copy(conn, conn)
+		return err
+	})), l)
+
+	c := NewClient(l.Addr().String(), k.clientConfig())
+	defer c.Close()
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the server deadline passes while the client stays silent
+	require.ErrorIs(t, <-serverErr, os.ErrDeadlineExceeded)
+
+	echoed := func(msg string) {
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+
+	echoed("hello")
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// a passed read deadline leaves writes alone, and can be extended
+	_, err = conn.Write([]byte("again"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(buf))
+
+	// a passed write deadline fails the pending write only
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write([]byte("late"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, conn.SetWriteDeadline(time.Time{}))
+	echoed("hello")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	k := newKeys(t)
+
+	l := listen(t)
+	serve(t, NewServer(echo(t, "hello"), k.host, WithHandshakeTimeout(50*time.Millisecond)), l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the client never speaks, the server gives up on it
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.Copy(io.Discard, conn)
+	require.NoError(t, err)
+}
+
+func TestKeepAlive(t *testing.T) {
+	k := newKeys(t)
+
+	t.Run("alive", func(t *testing.T) {
+		l := listen(t)
+		serve(t, k.server(echo(t, "hello")), l)
+
+		c := NewClient(l.Addr().String(), k.clientConfig(), WithKeepAlive(10*time.Millisecond, time.Second))
+		defer c.Close()
+
+		client, err := c.session(t.Context())
+		require.NoError(t, err)
+
+		time.Sleep(100 * time.Millisecond)
+
+		// the server replied to every keepalive
+		client2, err := c.session(t.Context())
+		require.NoError(t, err)
+		assert.Same(t, client, client2)
+	})
+
+	t.Run("unresponsive", func(t *testing.T) {
+		l := listen(t)
+		defer l.Close()
+
+		// the server never handles global requests, keepalives go unanswered
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, chans, _, err := ssh.NewServerConn(conn, k.server(nil).config)
+			if err != nil {
+				return
+			}
+			for newCh := range chans {
+				_ = newCh.Reject(ssh.Prohibited, "")
+			}
+		}()
+
+		c := NewClient(l.Addr().String(), k.clientConfig(), WithKeepAlive(10*time.Millisecond, 50*time.Millisecond))
+		defer c.Close()
+
+		client, err := c.session(t.Context())
+		require.NoError(t, err)
+
+		done := make(chan error)
+		go func() {
+			done <- client.Wait()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the unresponsive conn was kept")
+		}
+	})
+}
+
+func TestConcurrentDial(t *testing.T) {
+	k := newKeys(t)
+
+	var mu sync.Mutex
+	sconns := map[*ssh.ServerConn]bool{}
+
+	l := listen(t)
+	serve(t, k.server(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		mu.Lock()
+		sconns[ServerConnFromContext(ctx)] = true
+		mu.Unlock()
+
+		return echo(t, "hello")(ctx, conn)
+	})), l)
+
+	c := NewClient(l.Addr().String(), k.clientConfig())
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 10 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	// the concurrent Opens shared a single SSH conn
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, sconns, 1)
+}
@@ -0,0 +1,143 @@
+package tuntunstdio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+type ClientOption func(c *Client)
+
+// WithEnv adds variables, as key=value, to the environment of the command,
+// which otherwise inherits the one of the process.
+func WithEnv(env ...string) ClientOption {
+	return func(c *Client) {
+		c.env = append(c.env, env...)
+	}
+}
+
+// WithDir sets the working directory of the command.
+func WithDir(dir string) ClientOption {
+	return func(c *Client) {
+		c.dir = dir
+	}
+}
+
+// WithStderr sets where the stderr of the command goes, the stderr of the
+// process by default as for an ssh ProxyCommand. A nil w discards it.
+func WithStderr(w io.Writer) ClientOption {
+	return func(c *Client) {
+		c.stderr = w
+	}
+}
+
+// WithCloseTimeout sets how long closing a conn waits for its command to exit
+// once its stdin is closed before killing it, 5s by default.
+func WithCloseTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.closeTimeout = d
+	}
+}
+
+// NewClient returns an Opener launching command for every conn, the conn being
+// carried by its stdin and stdout, e.g. `ssh bastion example serve-stdio` served
+// by Server.ServeStdio. Put tuntunmux on top to share a single command.
+func NewClient(command []string, opts ...ClientOption) *Client {
+	c := &Client{
+		command:      command,
+		stderr:       os.Stderr,
+		closeTimeout: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type Client struct {
+	command      []string
+	env          []string
+	dir          string
+	stderr       io.Writer
+	closeTimeout time.Duration
+}
+
+// Open launches the command, it runs until the conn is closed regardless of ctx.
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	if len(c.command) == 0 {
+		return nil, errors.New("stdio: empty command")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	cmd.Dir = c.dir
+	cmd.Stderr = c.stderr
+	if c.env != nil {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+
+	// the pipes are created here rather than with StdinPipe and StdoutPipe, so
+	// that waiting for the command does not close them while still read
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		_ = stdinR.Close()
+		_ = stdinW.Close()
+		return nil, err
+	}
+
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+
+	err = cmd.Start()
+	_ = stdinR.Close()
+	_ = stdoutW.Close()
+	if err != nil {
+		_ = stdinW.Close()
+		_ = stdoutR.Close()
+		return nil, fmt.Errorf("stdio: %w", err)
+	}
+
+	done := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(done)
+	}()
+
+	conn := newConn(stdoutR, stdinW, Addr("stdio"), Addr(cmd.String()))
+	conn.onClose = func() error {
+		timer := time.NewTimer(c.closeTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+		case <-timer.C:
+			_ = cmd.Process.Kill()
+			<-done
+
+			return fmt.Errorf("stdio: killed command after %v", c.closeTimeout)
+		}
+
+		if waitErr != nil {
+			return fmt.Errorf("stdio: %w", waitErr)
+		}
+
+		return nil
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,104 @@
+package tuntunstdio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Addr is the address of a stdio conn, e.g. its command.
+type Addr string
+
+func (a Addr) Network() string {
+	return "stdio"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Conn is a net.Conn reading from a file and writing to another, e.g. the stdout
+// and stdin of a command.
+type Conn struct {
+	r     *os.File
+	w     *os.File
+	laddr net.Addr
+	raddr net.Addr
+
+	// onClose runs once both files are closed
+	onClose   func() error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(r, w *os.File, laddr, raddr net.Addr) *Conn {
+	return &Conn{
+		r:     r,
+		w:     w,
+		laddr: laddr,
+		raddr: raddr,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite closes the written file, the peer reads EOF.
+func (c *Conn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		err := c.w.Close()
+		if errors.Is(err, os.ErrClosed) {
+			// closed by CloseWrite
+			err = nil
+		}
+
+		c.closeErr = errors.Join(err, c.r.Close())
+
+		if c.onClose != nil {
+			c.closeErr = errors.Join(c.closeErr, c.onClose())
+		}
+	})
+
+	return c.closeErr
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Deadlines are only supported by pipes, os.ErrNoDeadline is returned for other
+// files.
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	err := c.r.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
@@ -0,0 +1,63 @@
+package tuntunstdio
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"tuntuntun"
+)
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// Server serves a single conn over a pair of files, e.g. the stdio of the
+// process launched by a Client.
+type Server struct {
+	handler tuntuntun.Handler
+	logger  *slog.Logger
+}
+
+func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
+	s := &Server{
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ServeStdio serves the conn carried by the stdin and stdout of the process.
+// Nothing else may write to stdout, e.g. logs must go to stderr.
+func (s *Server) ServeStdio(ctx context.Context) error {
+	return s.Serve(ctx, os.Stdin, os.Stdout)
+}
+
+// Serve serves the conn reading from r and writing to w until the handler
+// returns, the files are then closed. Cancelling ctx closes them too, which only
+// interrupts pending reads and writes of pipes, and Serve then returns nil.
+func (s *Server) Serve(ctx context.Context, r, w *os.File) error {
+	conn := newConn(r, w, Addr("stdio"), Addr("stdio"))
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	err := s.handler.ServeConn(ctx, conn)
+	if err != nil && ctx.Err() == nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelError, "stdio: failed to serve", slog.String("err", err.Error()))
+		}
+		return err
+	}
+
+	return nil
+}
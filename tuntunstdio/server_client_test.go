@@ -0,0 +1,205 @@
+package tuntunstdio
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+	"tuntuntun"
+	"tuntuntun/tuntunmux"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(expected string) tuntuntun.HandlerFunc {
+	return func(ctx context.Context, conn io.ReadWriteCloser) error {
+		defer conn.Close()
+
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("said: " + string(buf)))
+
+		return err
+	}
+}
+
+func roundtrip(t *testing.T, conn net.Conn, sent string) {
+	expected := "said: " + sent
+
+	go func() {
+		_, _ = conn.Write([]byte(sent))
+	}()
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, string(buf))
+}
+
+const helperEnv = "TUNTUNSTDIO_HELPER"
+
+// TestHelperProcess is the command launched by the clients of the tests, it
+// behaves as set by helperEnv.
+func TestHelperProcess(t *testing.T) {
+	helper := os.Getenv(helperEnv)
+	if helper == "" {
+		t.Skip("only run as a helper process")
+	}
+
+	ctx := context.Background()
+
+	var err error
+	switch helper {
+	case "echo":
+		err = NewServer(echo("hello")).ServeStdio(ctx)
+	case "mux":
+		err = NewServer(tuntunmux.NewServer(echo("hello"))).ServeStdio(ctx)
+	case "cat":
+		_, err = io.Copy(os.Stdout, os.Stdin)
+	case "exit":
+		os.Exit(3)
+	case "hang":
+		select {}
+	}
+	if err != nil {
+		_, _ = os.Stderr.WriteString(err.Error())
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func helper(t *testing.T, name string, opts ...ClientOption) *Client {
+	opts = append([]ClientOption{WithEnv(helperEnv + "=" + name)}, opts...)
+
+	return NewClient([]string{os.Args[0], "-test.run=^TestHelperProcess$"}, opts...)
+}
+
+func TestSanity(t *testing.T) {
+	c := helper(t, "echo")
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+
+	roundtrip(t, conn, "hello")
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, conn.Close())
+}
+
+func TestHalfClose(t *testing.T) {
+	c := helper(t, "cat")
+
+	conn, err := c.Open(t.Context())
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.(*Conn).CloseWrite())
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	require.NoError(t, conn.Close())
+}
+
+func TestMux(t *testing.T) {
+	c := tuntunmux.NewClient(helper(t, "mux"))
+	defer c.Close()
+
+	var g errgroup.Group
+	for range 100 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+}
+
+func TestClose(t *testing.T) {
+	t.Run("exit status", func(t *testing.T) {
+		conn, err := helper(t, "exit").Open(t.Context())
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		err = conn.Close()
+
+		var eerr *exec.ExitError
+		require.ErrorAs(t, err, &eerr)
+		assert.Equal(t, 3, eerr.ExitCode())
+	})
+
+	t.Run("kill", func(t *testing.T) {
+		conn, err := helper(t, "hang", WithCloseTimeout(100*time.Millisecond)).Open(t.Context())
+		require.NoError(t, err)
+
+		require.ErrorContains(t, conn.Close(), "killed command")
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		_, err := NewClient([]string{"tuntunstdio-does-not-exist"}).Open(t.Context())
+		require.ErrorIs(t, err, exec.ErrNotFound)
+	})
+}
+
+func TestServe(t *testing.T) {
+	clientR, serverW, err := os.Pipe()
+	require.NoError(t, err)
+	serverR, clientW, err := os.Pipe()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan error)
+	go func() {
+		done <- NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			// waits for the cancellation to close the conn
+			_, err := io.ReadAll(conn)
+			return err
+		})).Serve(ctx, serverR, serverW)
+	}()
+
+	conn := newConn(clientR, clientW, Addr("stdio"), Addr("stdio"))
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		// the handler failing on the closed files is not an error
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
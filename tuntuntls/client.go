@@ -0,0 +1,146 @@
+package tuntuntls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+)
+
+type ClientOption func(c *Client)
+
+// WithTLSConfig sets the TLS configuration used to reach the server, it is
+// cloned and completed with the ALPN protocol. WithRootCAs, WithServerName and
+// WithClientCertificate apply on top of it, whatever the order of the options.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithRootCAs sets the certificate authorities the server certificate is
+// verified against, the system ones are used by default.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate adds a certificate presented to servers requiring
+// client authentication.
+func WithClientCertificate(cert tls.Certificate) ClientOption {
+	return func(c *Client) {
+		c.certificates = append(c.certificates, cert)
+	}
+}
+
+// WithServerName overrides the name the server certificate is verified against,
+// which defaults to the host of the address.
+func WithServerName(name string) ClientOption {
+	return func(c *Client) {
+		c.serverName = name
+	}
+}
+
+// WithPlaintext makes the client open plain TCP conns, without TLS, to a server
+// using WithServerPlaintext.
+func WithPlaintext() ClientOption {
+	return func(c *Client) {
+		c.plaintext = true
+	}
+}
+
+// WithDialer sets the dialer of the TCP conns.
+func WithDialer(d *net.Dialer) ClientOption {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// NewClient returns a client opening conns to the server at the TCP address
+// addr, over TLS unless WithPlaintext is set.
+func NewClient(addr string, opts ...ClientOption) *Client {
+	c := &Client{
+		addr:   addr,
+		dialer: &net.Dialer{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.tlsConfig = c.tls()
+	if !slices.Contains(c.tlsConfig.NextProtos, ALPN) {
+		c.tlsConfig.NextProtos = append(c.tlsConfig.NextProtos, ALPN)
+	}
+
+	return c
+}
+
+type Client struct {
+	addr         string
+	tlsConfig    *tls.Config
+	rootCAs      *x509.CertPool
+	certificates []tls.Certificate
+	serverName   string
+	plaintext    bool
+	dialer       *net.Dialer
+}
+
+// tls returns the TLS configuration of the client, with the options applied on
+// top of the one set with WithTLSConfig.
+func (c *Client) tls() *tls.Config {
+	cfg := c.tlsConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if c.rootCAs != nil {
+		cfg.RootCAs = c.rootCAs
+	}
+	if c.serverName != "" {
+		cfg.ServerName = c.serverName
+	}
+	cfg.Certificates = append(cfg.Certificates, c.certificates...)
+
+	return cfg
+}
+
+func (c *Client) Open(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.plaintext {
+		return conn, nil
+	}
+
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != ALPN {
+		_ = tlsConn.Close()
+		return nil, fmt.Errorf("tls: server negotiated %q instead of %q", p, ALPN)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,230 @@
+package tuntuntls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"tuntuntun"
+)
+
+// ALPN is the protocol negotiated by clients, so that a TLS port can serve both
+// conns and HTTPS.
+const ALPN = "tuntun"
+
+type Option func(s *Server)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// ErrNoTLSConfig is returned by Serve when the server was given neither
+// WithServerTLSConfig nor WithServerPlaintext.
+var ErrNoTLSConfig = errors.New("tls: no TLS configuration, use WithServerTLSConfig or WithServerPlaintext")
+
+// WithServerTLSConfig makes the server accept TLS conns, the configuration is
+// cloned and completed with the ALPN protocol.
+func WithServerTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithServerPlaintext makes the server accept plain TCP conns, without TLS. Like
+// the client, the server does not fall back to plaintext on its own.
+func WithServerPlaintext() Option {
+	return func(s *Server) {
+		s.plaintext = true
+	}
+}
+
+// WithClientCAs requires clients to present a certificate signed by one of the
+// authorities in pool, it requires WithServerTLSConfig.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(s *Server) {
+		s.clientCAs = pool
+	}
+}
+
+// Server serves every conn accepted from a listener.
+type Server struct {
+	handler   tuntuntun.Handler
+	logger    *slog.Logger
+	tlsConfig *tls.Config
+	plaintext bool
+	clientCAs *x509.CertPool
+}
+
+func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
+	s := &Server{
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.tlsConfig != nil {
+		if !slices.Contains(s.tlsConfig.NextProtos, ALPN) {
+			s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, ALPN)
+		}
+
+		if s.clientCAs != nil {
+			s.tlsConfig.ClientCAs = s.clientCAs
+			s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return s
+}
+
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	if s.tlsConfig == nil && !s.plaintext {
+		return ErrNoTLSConfig
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts conns from l until ctx is cancelled or l is closed, it then
+// closes l and returns once the handlers returned. Conns are served over TLS
+// with WithServerTLSConfig, or plain TCP with WithServerPlaintext.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if s.tlsConfig == nil && !s.plaintext {
+		_ = l.Close()
+		return ErrNoTLSConfig
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = l.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if s.tlsConfig != nil {
+				conn = tls.Server(conn, s.tlsConfig)
+			}
+
+			s.serve(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// the conn does not outlive the server
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Log(ctx, slog.LevelWarn, "tls: failed handshake", slog.String("err", err.Error()))
+			}
+			return
+		}
+
+		// clients without ALPN are accepted
+		if p := tlsConn.ConnectionState().NegotiatedProtocol; p != "" && p != ALPN {
+			if s.logger != nil {
+				s.logger.Log(ctx, slog.LevelWarn, "tls: unexpected protocol", slog.String("protocol", p))
+			}
+			return
+		}
+	}
+
+	err := s.handler.ServeConn(ctx, conn)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Log(ctx, slog.LevelError, "tls: failed to serve", slog.String("err", err.Error()))
+		}
+		return
+	}
+}
+
+// ConfigureHTTPServer makes hs serve the conns negotiating the ALPN protocol on
+// its TLS port, next to HTTPS. HTTP/2 stays enabled unless hs.Protocols says
+// otherwise. The options of the server, besides the logger, are ignored.
+func (s *Server) ConfigureHTTPServer(hs *http.Server) error {
+	if _, ok := hs.TLSNextProto[ALPN]; ok {
+		return fmt.Errorf("tls: %v is already configured", ALPN)
+	}
+
+	if hs.TLSNextProto == nil {
+		// a non-nil TLSNextProto disables HTTP/2, unless asked for
+		if hs.Protocols == nil {
+			hs.Protocols = &http.Protocols{}
+			hs.Protocols.SetHTTP1(true)
+			hs.Protocols.SetHTTP2(true)
+		}
+
+		hs.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	hs.TLSNextProto[ALPN] = s.serveTLSNextProto
+
+	if hs.TLSConfig == nil {
+		hs.TLSConfig = &tls.Config{}
+
+		// http.Server.Serve only serves HTTP/2 when its TLS configuration
+		// mentions it
+		if hs.Protocols != nil && hs.Protocols.HTTP2() {
+			hs.TLSConfig.NextProtos = append(hs.TLSConfig.NextProtos, "h2")
+		}
+		hs.TLSConfig.NextProtos = append(hs.TLSConfig.NextProtos, "http/1.1")
+	}
+	if !slices.Contains(hs.TLSConfig.NextProtos, ALPN) {
+		hs.TLSConfig.NextProtos = append(hs.TLSConfig.NextProtos, ALPN)
+	}
+
+	return nil
+}
+
+func (s *Server) serveTLSNextProto(hs *http.Server, conn *tls.Conn, h http.Handler) {
+	ctx := context.Background()
+	// the handler passed by http.Server carries the context of the conn
+	if bc, ok := h.(interface{ BaseContext() context.Context }); ok {
+		ctx = bc.BaseContext()
+	}
+
+	s.serve(ctx, conn)
+}
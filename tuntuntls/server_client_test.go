@@ -0,0 +1,254 @@
+package tuntuntls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tuntuntun"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(t *testing.T, expected string) tuntuntun.HandlerFunc {
+	return func(ctx context.Context, conn io.ReadWriteCloser) error {
+		defer conn.Close()
+
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("said: " + string(buf)))
+
+		return err
+	}
+}
+
+func roundtrip(t *testing.T, conn net.Conn, sent string) {
+	expected := "said: " + sent
+
+	go func() {
+		_, _ = conn.Write([]byte(sent))
+	}()
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, string(buf))
+}
+
+// certificate returns a self-signed certificate for localhost, and a pool
+// trusting it.
+func certificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// serve serves on a loopback port until the test ends.
+func serve(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return l.Addr().String()
+}
+
+func TestSanity(t *testing.T) {
+	addr := serve(t, NewServer(echo(t, "hello"), WithServerPlaintext()))
+
+	c := NewClient(addr, WithPlaintext())
+
+	var g errgroup.Group
+	for range 100 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, "hello")
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+}
+
+func TestNoTLSConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// neither TLS nor plaintext was asked for
+	err = NewServer(echo(t, "hello")).Serve(t.Context(), l)
+	require.ErrorIs(t, err, ErrNoTLSConfig)
+
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := certificate(t)
+
+	addr := serve(t, NewServer(echo(t, "hello"), WithServerTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})))
+
+	t.Run("trusted", func(t *testing.T) {
+		conn, err := NewClient(addr, WithRootCAs(pool)).Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		roundtrip(t, conn, "hello")
+
+		assert.Equal(t, ALPN, conn.(*tls.Conn).ConnectionState().NegotiatedProtocol)
+	})
+
+	t.Run("tls config", func(t *testing.T) {
+		cfg := &tls.Config{ServerName: "other.test"}
+
+		// the other options apply on top of the config, in any order
+		for _, opts := range [][]ClientOption{
+			{WithTLSConfig(cfg), WithRootCAs(pool), WithServerName("localhost")},
+			{WithRootCAs(pool), WithServerName("localhost"), WithTLSConfig(cfg)},
+		} {
+			conn, err := NewClient(addr, opts...).Open(t.Context())
+			require.NoError(t, err)
+
+			roundtrip(t, conn, "hello")
+			conn.Close()
+		}
+
+		assert.Equal(t, "other.test", cfg.ServerName)
+		assert.Empty(t, cfg.NextProtos)
+	})
+
+	t.Run("unknown authority", func(t *testing.T) {
+		_, err := NewClient(addr).Open(t.Context())
+
+		var uerr x509.UnknownAuthorityError
+		require.ErrorAs(t, err, &uerr)
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		conn, err := NewClient(addr, WithPlaintext()).Open(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("hello"))
+
+		// the server hangs up after the failed handshake
+		b, _ := io.ReadAll(conn)
+		assert.NotContains(t, string(b), "said")
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	cert, pool := certificate(t)
+
+	var peerCerts []*x509.Certificate
+	addr := serve(t, NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		peerCerts = conn.(*tls.Conn).ConnectionState().PeerCertificates
+
+		return echo(t, "hello")(ctx, conn)
+	}), WithServerTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}), WithClientCAs(pool)))
+
+	conn, err := NewClient(addr, WithRootCAs(pool), WithClientCertificate(cert)).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, "hello")
+
+	require.Len(t, peerCerts, 1)
+	assert.Equal(t, cert.Certificate[0], peerCerts[0].Raw)
+
+	// with TLS 1.3, the client learns that its certificate was rejected once
+	// it reads
+	conn, err = NewClient(addr, WithRootCAs(pool)).Open(t.Context())
+	if err == nil {
+		defer conn.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+}
+
+func TestHTTPServer(t *testing.T) {
+	cert, pool := certificate(t)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	require.NoError(t, NewServer(echo(t, "hello")).ConfigureHTTPServer(srv.Config))
+	srv.TLS.NextProtos = srv.Config.TLSConfig.NextProtos
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	addr := srv.Listener.Addr().String()
+
+	conn, err := NewClient(addr, WithRootCAs(pool)).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundtrip(t, conn, "hello")
+
+	// HTTPS is still served, over HTTP/2
+	hc := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := hc.Get("https://" + addr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", string(b))
+}
@@ -4,29 +4,213 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
+	"golang.org/x/net/http2"
 )
 
-func NewClient(url string) *Client {
-	return &Client{
-		url: url,
+type ClientOption func(c *Client)
+
+// WithHeader adds a header to the handshake request, e.g. Authorization.
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		c.header.Add(key, value)
+	}
+}
+
+// WithHeaderFunc registers a function computing headers for every dial, so that
+// short-lived credentials are refreshed on each reconnect. Its headers replace
+// the static ones with the same key.
+func WithHeaderFunc(f func(ctx context.Context) (http.Header, error)) ClientOption {
+	return func(c *Client) {
+		c.headerFunc = f
 	}
 }
 
+// WithHTTPClient sets the client used for the handshake, e.g. for TLS roots,
+// proxies or cookies. Its Timeout must be zero, as for websocket.DialOptions.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithDialOptions registers a function tuning the options of every dial, the
+// tuntun subprotocol is always requested.
+func WithDialOptions(f func(opts *websocket.DialOptions)) ClientOption {
+	return func(c *Client) {
+		c.dialOptions = append(c.dialOptions, f)
+	}
+}
+
+// WithClientPing sets how often the client pings the server and how long it
+// waits for the pong before closing the conn, zero disables pings. Defaults to
+// DefaultPingInterval and DefaultPingTimeout.
+func WithClientPing(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pingInterval = interval
+		c.pingTimeout = timeout
+	}
+}
+
+// WithHTTP2 opens conns as streams of an HTTP/2 connection, with extended
+// CONNECT requests as in RFC 8441, so that they share a single connection to the
+// server. When the server answers that it does not support it, or negotiates
+// HTTP/1.1, the client falls back to the HTTP/1.1 upgrade for
+// HTTP2RetryInterval before trying HTTP/2 again. Failing to reach the server
+// does not make it fall back. A nil t speaks h2c to ws and http urls, and TLS to
+// the others.
+func WithHTTP2(t *http2.Transport) ClientOption {
+	return func(c *Client) {
+		c.h2 = true
+		c.h2Transport = t
+	}
+}
+
+// HTTP2RetryInterval is how long a client using WithHTTP2 upgrades over
+// HTTP/1.1 once the server answered that it does not support extended CONNECT.
+const HTTP2RetryInterval = 10 * time.Minute
+
+func NewClient(url string, opts ...ClientOption) *Client {
+	c := &Client{
+		url:          url,
+		header:       http.Header{},
+		pingInterval: DefaultPingInterval,
+		pingTimeout:  DefaultPingTimeout,
+		h2Retry:      HTTP2RetryInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.h2 {
+		t := c.h2Transport
+		if t == nil {
+			t = newHTTP2Transport(url, func() {
+				c.h1Peer.Store(true)
+			})
+		}
+
+		c.h2Client = &http.Client{Transport: &extendedConnectTransport{t: t}}
+	}
+
+	return c
+}
+
 type Client struct {
-	url string
+	url          string
+	header       http.Header
+	headerFunc   func(ctx context.Context) (http.Header, error)
+	httpClient   *http.Client
+	dialOptions  []func(opts *websocket.DialOptions)
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	h2           bool
+	h2Transport  *http2.Transport
+	h2Client     *http.Client
+	h2Retry      time.Duration
+	// h1Until is when to try HTTP/2 again, in Unix nanoseconds, after the
+	// server answered that it does not support extended CONNECT.
+	h1Until atomic.Int64
+	// h1Peer is set when the server answered an h2c conn in HTTP/1.1.
+	h1Peer atomic.Bool
 }
 
-func (c *Client) Connect(ctx context.Context) (net.Conn, *http.Response, error) {
-	conn, res, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{
+// fallenBack reports whether conns are upgraded over HTTP/1.1 for now, after
+// the server refused extended CONNECT.
+func (c *Client) fallenBack() bool {
+	return time.Now().UnixNano() < c.h1Until.Load()
+}
+
+func (c *Client) options(ctx context.Context) (*websocket.DialOptions, error) {
+	header := c.header.Clone()
+	if c.headerFunc != nil {
+		h, err := c.headerFunc(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range h {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+
+	opts := &websocket.DialOptions{
+		HTTPClient:   c.httpClient,
+		HTTPHeader:   header,
 		Subprotocols: []string{SubProtocol},
-	})
+	}
+	for _, f := range c.dialOptions {
+		f(opts)
+	}
+
+	if !slices.Contains(opts.Subprotocols, SubProtocol) {
+		opts.Subprotocols = append(opts.Subprotocols, SubProtocol)
+	}
+
+	return opts, nil
+}
+
+func (c *Client) Connect(ctx context.Context) (net.Conn, *http.Response, error) {
+	opts, err := c.options(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return websocket.NetConn(ctx, conn, websocket.MessageBinary), res, nil
+	if c.h2Client != nil && !c.fallenBack() {
+		h1Client := opts.HTTPClient
+		opts.HTTPClient = c.h2Client
+
+		conn, res, err := c.dial(ctx, opts)
+		if err == nil {
+			return conn, res, nil
+		}
+
+		h1Peer := c.h1Peer.Swap(false)
+		if res != nil || !(extendedConnectUnsupported(err) || h1Peer) {
+			return nil, res, err
+		}
+
+		c.h1Until.Store(time.Now().Add(c.h2Retry).UnixNano())
+		opts.HTTPClient = h1Client
+	}
+
+	conn, res, err := c.dial(ctx, opts)
+	if err != nil {
+		// res holds the rejection, if any
+		return nil, res, err
+	}
+
+	return conn, res, nil
+}
+
+// dial opens a conn living as long as ctx, with the addresses of the
+// connection carrying it.
+func (c *Client) dial(ctx context.Context, opts *websocket.DialOptions) (*Conn, *http.Response, error) {
+	var laddr, raddr net.Addr
+	traceCtx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			laddr = info.Conn.LocalAddr()
+			raddr = info.Conn.RemoteAddr()
+		},
+	})
+
+	ws, res, err := websocket.Dial(traceCtx, c.url, opts)
+	if err != nil {
+		return nil, res, err
+	}
+
+	conn := newConn(ctx, ws, c.pingInterval, c.pingTimeout)
+	if laddr != nil {
+		conn.laddr = laddr
+		conn.raddr = raddr
+	}
+
+	return conn, res, nil
 }
 
 func (c *Client) Open(ctx context.Context) (net.Conn, error) {
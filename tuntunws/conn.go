@@ -0,0 +1,324 @@
+package tuntunws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+	"tuntuntun/internal/pipeconn"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPingTimeout  = 15 * time.Second
+)
+
+var ErrPingTimeout = errors.New("ws: ping timeout")
+
+// CloseError is returned once the peer closed the conn with a status other than
+// a normal closure.
+type CloseError struct {
+	Code   websocket.StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("ws: closed with status %v: %q", e.Code, e.Reason)
+}
+
+// Retryable reports whether reconnecting may succeed, e.g. after the peer went
+// away, as opposed to a policy violation.
+func (e *CloseError) Retryable() bool {
+	switch e.Code {
+	case websocket.StatusGoingAway,
+		websocket.StatusAbnormalClosure,
+		websocket.StatusInternalError,
+		websocket.StatusServiceRestart,
+		websocket.StatusTryAgainLater,
+		websocket.StatusBadGateway:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsRetryable reports whether a conn that failed with err is worth reopening,
+// only close errors can tell otherwise.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var cerr *CloseError
+	if errors.As(err, &cerr) {
+		return cerr.Retryable()
+	}
+
+	return true
+}
+
+type wsAddr struct {
+}
+
+func (a wsAddr) Network() string {
+	return "websocket"
+}
+
+func (a wsAddr) String() string {
+	return "websocket/unknown-addr"
+}
+
+// closeTimeout bounds how long Close waits for the written data to be sent.
+const closeTimeout = 5 * time.Second
+
+// Conn is a net.Conn carried by binary WebSocket messages, it pings the peer to
+// keep the conn alive and reports close statuses as *CloseError. Reads and
+// writes go through pipes pumped from and to the WebSocket, so that a deadline
+// only interrupts the pending calls in its direction and can be extended once
+// passed.
+type Conn struct {
+	ws     *websocket.Conn
+	cancel context.CancelFunc
+
+	r *pipeconn.PipeReader
+	w *pipeconn.PipeWriter
+
+	laddr net.Addr
+	raddr net.Addr
+
+	pingErr atomic.Bool
+	// stalled is set while the read pump waits for the conn to be read, writing
+	// while a message is being written.
+	stalled atomic.Bool
+	writing atomic.Bool
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// newConn returns a conn living as long as ctx, pinging the peer every
+// pingInterval unless zero.
+func newConn(ctx context.Context, ws *websocket.Conn, pingInterval, pingTimeout time.Duration) *Conn {
+	ws.SetReadLimit(-1)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	c := &Conn{
+		ws:     ws,
+		cancel: cancel,
+		laddr:  wsAddr{},
+		raddr:  wsAddr{},
+	}
+	c.r = pipeconn.NewPipeReader(&messageReader{ctx: ctx, c: c})
+	c.w = pipeconn.NewPipeWriter(&messageWriter{ctx: ctx, c: c})
+
+	if pingInterval > 0 {
+		go c.keepAlive(ctx, pingInterval, pingTimeout)
+	}
+
+	return c
+}
+
+// keepAlive pings the peer every interval. Pongs are only received while the
+// WebSocket is read, so an unanswered ping only fails the conn when it is not
+// held up by backpressure: the conn not being read, or the peer not reading.
+func (c *Conn) keepAlive(ctx context.Context, interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		// a write cancelled by its context closes the WebSocket, the ping
+		// timeout is handled here instead
+		pong := make(chan error, 1)
+		go func() {
+			pong <- c.ws.Ping(ctx)
+		}()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case err := <-pong:
+			timer.Stop()
+			if err != nil {
+				return
+			}
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if c.stalled.Load() || c.writing.Load() {
+			err := <-pong
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		c.pingErr.Store(true)
+		_ = c.ws.CloseNow()
+		return
+	}
+}
+
+// MaxMessageSize is the largest message sent by a Conn, a write is sent as
+// messages of at most MaxMessageSize bytes.
+const MaxMessageSize = pipeconn.BufferSize
+
+// SetReadLimit sets the max size of a message read from the peer, which is
+// unlimited by default, see MaxMessageSize.
+func (c *Conn) SetReadLimit(n int64) {
+	c.ws.SetReadLimit(n)
+}
+
+func (c *Conn) err(err error) error {
+	if c.pingErr.Load() {
+		return ErrPingTimeout
+	}
+
+	var cerr websocket.CloseError
+	if errors.As(err, &cerr) {
+		if cerr.Code == websocket.StatusNormalClosure {
+			return io.EOF
+		}
+
+		return &CloseError{Code: cerr.Code, Reason: cerr.Reason}
+	}
+
+	return err
+}
+
+// messageReader reads the binary messages of the conn as a stream.
+type messageReader struct {
+	ctx    context.Context
+	c      *Conn
+	reader io.Reader
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	r.c.stalled.Store(false)
+	defer r.c.stalled.Store(true)
+
+	for {
+		if r.reader == nil {
+			typ, mr, err := r.c.ws.Reader(r.ctx)
+			if err != nil {
+				return 0, r.c.err(err)
+			}
+
+			if typ != websocket.MessageBinary {
+				err := fmt.Errorf("ws: unexpected message type %v", typ)
+				_ = r.c.ws.Close(websocket.StatusUnsupportedData, err.Error())
+				return 0, err
+			}
+			r.reader = mr
+		}
+
+		n, err := r.reader.Read(p)
+		if err == io.EOF {
+			r.reader = nil
+			err = nil
+		}
+		if err != nil {
+			return n, r.c.err(err)
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *messageReader) Close() error {
+	return nil
+}
+
+// messageWriter writes every write as a binary message.
+type messageWriter struct {
+	ctx context.Context
+	c   *Conn
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	w.c.writing.Store(true)
+	defer w.c.writing.Store(false)
+
+	err := w.c.ws.Write(w.ctx, websocket.MessageBinary, p)
+	if err != nil {
+		return 0, w.c.err(err)
+	}
+
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	return nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// flush waits for the written data to be sent, up to closeTimeout after which
+// the conn is torn down.
+func (c *Conn) flush() {
+	t := time.AfterFunc(closeTimeout, c.cancel)
+	defer t.Stop()
+
+	_ = c.w.Close()
+}
+
+func (c *Conn) Close() error {
+	return c.CloseWithStatus(websocket.StatusNormalClosure, "")
+}
+
+// CloseWithStatus closes the conn with a status the peer gets as a *CloseError,
+// e.g. websocket.StatusPolicyViolation to tell it not to reconnect.
+func (c *Conn) CloseWithStatus(code websocket.StatusCode, reason string) error {
+	c.flush()
+
+	err := c.ws.Close(code, reason)
+
+	c.cancel()
+	_ = c.r.Close()
+
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	err1 := c.SetReadDeadline(t)
+	err2 := c.SetWriteDeadline(t)
+
+	return errors.Join(err1, err2)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
@@ -0,0 +1,303 @@
+package tuntunws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Over HTTP/2, a WebSocket is a stream opened by an extended CONNECT request, as
+// in RFC 8441. The stream carries the same frames as an upgraded HTTP/1.1 conn,
+// only the handshake differs: it is translated to and from an HTTP/1.1 upgrade
+// so that the websocket package handles both.
+//
+// Go only advertises SETTINGS_ENABLE_CONNECT_PROTOCOL, and accepts extended
+// CONNECT requests, when the process runs with GODEBUG=http2xconnect=1.
+const (
+	protocolHeader    = ":protocol"
+	websocketProtocol = "websocket"
+	websocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// ExtendedConnectEnabled reports whether the process runs with
+// GODEBUG=http2xconnect=1, without which servers reject WebSockets over HTTP/2
+// and clients using WithHTTP2 fall back to HTTP/1.1. The setting is read from
+// the environment on init.
+func ExtendedConnectEnabled() bool {
+	return extendedConnectSetting(os.Getenv("GODEBUG"))
+}
+
+// extendedConnectSetting reads http2xconnect from the comma-separated settings
+// of godebug, the last one wins.
+func extendedConnectSetting(godebug string) bool {
+	enabled := false
+	for _, setting := range strings.Split(godebug, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if ok && k == "http2xconnect" {
+			enabled = v == "1"
+		}
+	}
+
+	return enabled
+}
+
+// extendedConnectUnsupported reports whether err is the server answering that
+// it does not support extended CONNECT, or negotiating a protocol other than
+// HTTP/2, as opposed to failing to reach it or losing the conn.
+func extendedConnectUnsupported(err error) bool {
+	msg := err.Error()
+
+	return strings.Contains(msg, "extended connect not supported by peer") ||
+		strings.Contains(msg, "http2: unexpected ALPN protocol") ||
+		(errors.Is(err, http2.ErrFrameTooLarge) && strings.Contains(msg, "looked like an HTTP/1.1 header"))
+}
+
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(protocolHeader) == websocketProtocol
+}
+
+func secWebSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(websocketGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// acceptExtendedConnect presents an extended CONNECT request as an HTTP/1.1
+// upgrade to websocket.Accept.
+func acceptExtendedConnect(w http.ResponseWriter, r *http.Request) (*extendedConnectWriter, *http.Request) {
+	r = r.Clone(r.Context())
+	r.Method = http.MethodGet
+	r.Header.Del(protocolHeader)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", websocketProtocol)
+	// the key only proves the upgrade, which the stream does not need
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	return &extendedConnectWriter{
+		ResponseWriter: w,
+		body:           r.Body,
+		rc:             http.NewResponseController(w),
+	}, r
+}
+
+// extendedConnectWriter answers the upgrade with a 200 and hijacks the stream.
+type extendedConnectWriter struct {
+	http.ResponseWriter
+	body io.ReadCloser
+	rc   *http.ResponseController
+
+	conn *streamConn
+}
+
+func (w *extendedConnectWriter) WriteHeader(status int) {
+	if status == http.StatusSwitchingProtocols {
+		h := w.Header()
+		h.Del("Connection")
+		h.Del("Upgrade")
+		h.Del("Sec-WebSocket-Accept")
+
+		status = http.StatusOK
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *extendedConnectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	err := w.rc.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &streamConn{r: w.body, w: w.ResponseWriter, rc: w.rc}
+
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// close prevents further writes, the ResponseWriter must not be used once the
+// handler returned.
+func (w *extendedConnectWriter) close() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+// streamConn is the server side of an extended CONNECT stream.
+type streamConn struct {
+	r  io.ReadCloser
+	w  io.Writer
+	rc *http.ResponseController
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	return c.r.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// newHTTP2Transport returns a transport speaking h2c to ws and http urls, and
+// TLS to the others. Without ALPN, h2c cannot negotiate HTTP/2: onHTTP1 is
+// called when the server answers in HTTP/1.1 instead.
+func newHTTP2Transport(rawURL string, onHTTP1 func()) *http2.Transport {
+	t := &http2.Transport{}
+
+	u, err := url.Parse(rawURL)
+	if err == nil && (u.Scheme == "ws" || u.Scheme == "http") {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return &http1Sniffer{Conn: conn, onHTTP1: onHTTP1}, nil
+		}
+	}
+
+	return t
+}
+
+// http1Sniffer calls onHTTP1 when the first bytes read from the conn are an
+// HTTP/1.1 response, which the http2 package only reports once the conn is
+// gone when extended CONNECT requests are waiting for its settings.
+type http1Sniffer struct {
+	net.Conn
+	onHTTP1 func()
+	once    sync.Once
+}
+
+func (c *http1Sniffer) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.once.Do(func() {
+		if bytes.HasPrefix(p[:n], []byte("HTTP/1.")) {
+			c.onHTTP1()
+		}
+	})
+
+	return n, err
+}
+
+// extendedConnectTransport sends an HTTP/1.1 upgrade from websocket.Dial as an
+// extended CONNECT request, and presents its response as the upgrade response.
+type extendedConnectTransport struct {
+	t *http2.Transport
+}
+
+func (t *extendedConnectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	pr, pw := io.Pipe()
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodConnect
+	req.Body = pr
+	req.Header.Del("Connection")
+	req.Header.Del("Upgrade")
+	req.Header.Del("Sec-WebSocket-Key")
+	req.Header.Set(protocolHeader, websocketProtocol)
+
+	resp, err := t.t.RoundTrip(req)
+	if err != nil {
+		_ = pw.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = pw.Close()
+		return resp, nil
+	}
+
+	resp.StatusCode = http.StatusSwitchingProtocols
+	resp.Status = http.StatusText(http.StatusSwitchingProtocols)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", websocketProtocol)
+	resp.Header.Set("Sec-WebSocket-Accept", secWebSocketAccept(key))
+	resp.Body = &streamBody{ReadCloser: resp.Body, w: pw}
+
+	return resp, nil
+}
+
+// streamBody is the client side of an extended CONNECT stream.
+type streamBody struct {
+	io.ReadCloser
+	w *io.PipeWriter
+}
+
+func (b *streamBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (b *streamBody) Close() error {
+	_ = b.w.Close()
+
+	return b.ReadCloser.Close()
+}
@@ -1,15 +1,32 @@
 package tuntunws
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 	"tuntuntun"
+	"tuntuntun/internal/httpconn"
 
 	"github.com/coder/websocket"
 )
 
 const SubProtocol = "tuntun"
 
+// IsRequest reports whether r opens a WebSocket, either an HTTP/1.1 upgrade or
+// an HTTP/2 extended CONNECT, so that the server can share a url with other
+// transports.
+func IsRequest(r *http.Request) bool {
+	if isExtendedConnect(r) {
+		return true
+	}
+
+	return strings.EqualFold(r.Header.Get("Upgrade"), websocketProtocol)
+}
+
 type Option func(s *Server)
 
 func WithLogger(l *slog.Logger) Option {
@@ -18,14 +35,81 @@ func WithLogger(l *slog.Logger) Option {
 	}
 }
 
+// WithOriginPatterns allows cross origin requests from the hosts matching the
+// patterns, as in websocket.AcceptOptions. The request host is always allowed.
+func WithOriginPatterns(patterns ...string) Option {
+	return func(s *Server) {
+		s.originPatterns = append(s.originPatterns, patterns...)
+	}
+}
+
+// WithReadLimit sets the max size of a message read from clients, it is
+// unlimited by default. Writes are sent as messages of up to MaxMessageSize
+// bytes, so a lower limit fails the conns of clients writing more than n bytes
+// at once.
+func WithReadLimit(n int64) Option {
+	return func(s *Server) {
+		s.readLimit = n
+	}
+}
+
+// WithCompressionMode sets the compression negotiated with clients, disabled by
+// default.
+func WithCompressionMode(mode websocket.CompressionMode) Option {
+	return func(s *Server) {
+		s.compressionMode = mode
+	}
+}
+
+// WithPing sets how often the server pings clients and how long it waits for the
+// pong before closing the conn, zero disables pings. Defaults to
+// DefaultPingInterval and DefaultPingTimeout.
+func WithPing(interval, timeout time.Duration) Option {
+	return func(s *Server) {
+		s.pingInterval = interval
+		s.pingTimeout = timeout
+	}
+}
+
+// RejectError rejects a request from a pre-accept hook with Status.
+type RejectError struct {
+	Status int
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rejected with status %v: %v", e.Status, e.Reason)
+}
+
+// WithPreAccept registers a hook called before upgrading a request, the request
+// is rejected when it returns an error, with the status of a *RejectError or
+// 403 otherwise.
+func WithPreAccept(f func(r *http.Request) error) Option {
+	return func(s *Server) {
+		s.preAccept = f
+	}
+}
+
+// Server accepts WebSocket conns upgraded from HTTP/1.1, or opened by an HTTP/2
+// extended CONNECT request as in RFC 8441 when the process runs with
+// GODEBUG=http2xconnect=1, which makes Go advertise
+// SETTINGS_ENABLE_CONNECT_PROTOCOL, see ExtendedConnectEnabled.
 type Server struct {
-	handler tuntuntun.Handler
-	logger  *slog.Logger
+	handler         tuntuntun.Handler
+	logger          *slog.Logger
+	originPatterns  []string
+	readLimit       int64
+	compressionMode websocket.CompressionMode
+	preAccept       func(r *http.Request) error
+	pingInterval    time.Duration
+	pingTimeout     time.Duration
 }
 
 func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
 	s := &Server{
-		handler: handler,
+		handler:      handler,
+		pingInterval: DefaultPingInterval,
+		pingTimeout:  DefaultPingTimeout,
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -35,11 +119,38 @@ func NewServer(handler tuntuntun.Handler, opts ...Option) *Server {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.preAccept != nil {
+		err := s.preAccept(r)
+		if err != nil {
+			status, reason := http.StatusForbidden, http.StatusText(http.StatusForbidden)
+
+			var rerr *RejectError
+			if errors.As(err, &rerr) {
+				status, reason = rerr.Status, rerr.Reason
+			}
+
+			http.Error(w, reason, status)
+			return
+		}
+	}
+
+	if isExtendedConnect(r) {
+		ecw, ecr := acceptExtendedConnect(w, r)
+		defer ecw.close()
+
+		w, r = ecw, ecr
+	}
+
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		Subprotocols: []string{SubProtocol},
+		Subprotocols:    []string{SubProtocol},
+		OriginPatterns:  s.originPatterns,
+		CompressionMode: s.compressionMode,
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Accept already wrote the error response
+		if s.logger != nil {
+			s.logger.Log(r.Context(), slog.LevelWarn, "ws: failed to accept", slog.String("err", err.Error()))
+		}
 		return
 	}
 	defer c.CloseNow()
@@ -49,7 +160,19 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.handler.ServeConn(r.Context(), websocket.NetConn(r.Context(), c, websocket.MessageBinary))
+	conn := newConn(r.Context(), c, s.pingInterval, s.pingTimeout)
+	// the written data is sent before the WebSocket is torn down
+	defer conn.flush()
+
+	conn.raddr = httpconn.ParseAddr(r.RemoteAddr, wsAddr{})
+	if laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.laddr = laddr
+	}
+	if s.readLimit > 0 {
+		conn.SetReadLimit(s.readLimit)
+	}
+
+	err = s.handler.ServeConn(r.Context(), conn)
 	if err != nil {
 		if s.logger != nil {
 			s.logger.Log(r.Context(), slog.LevelError, "ws: failed to serve", slog.String("err", err.Error()))
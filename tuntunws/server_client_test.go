@@ -2,15 +2,23 @@ package tuntunws
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"tuntuntun"
+	"tuntuntun/tuntunhttp"
 
+	"github.com/coder/websocket"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/stretchr/testify/assert"
@@ -126,3 +134,493 @@ func TestStress(t *testing.T) {
 
 	g.Wait()
 }
+
+type countingTransport struct {
+	count atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestClientOptions(t *testing.T) {
+	toWrite := "hello"
+
+	headers := make(chan http.Header, 2)
+	h := newServer(echo(t, toWrite))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var tokens atomic.Int64
+	transport := &countingTransport{}
+
+	c := NewClient(srv.URL,
+		WithHeader("Authorization", "Bearer static"),
+		WithHeader("X-Token", "static"),
+		WithHeaderFunc(func(ctx context.Context) (http.Header, error) {
+			return http.Header{"X-Token": {fmt.Sprint(tokens.Add(1))}}, nil
+		}),
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithDialOptions(func(opts *websocket.DialOptions) {
+			opts.Subprotocols = []string{"other"}
+		}),
+	)
+
+	for i := range 2 {
+		conn, res, err := c.Connect(t.Context())
+		require.NoError(t, err)
+
+		assert.Equal(t, SubProtocol, res.Header.Get("Sec-WebSocket-Protocol"))
+
+		roundtrip(t, conn, toWrite)
+		conn.Close()
+
+		header := <-headers
+		assert.Equal(t, "Bearer static", header.Get("Authorization"))
+		// the header is computed on every dial
+		assert.Equal(t, []string{fmt.Sprint(i + 1)}, header.Values("X-Token"))
+	}
+
+	assert.EqualValues(t, 2, transport.count.Load())
+
+	c = NewClient(srv.URL, WithHeaderFunc(func(ctx context.Context) (http.Header, error) {
+		return nil, errors.New("token expired")
+	}))
+
+	_, err := c.Open(t.Context())
+	require.ErrorContains(t, err, "token expired")
+}
+
+func TestServerOptions(t *testing.T) {
+	toWrite := "hello"
+
+	readErr := make(chan error, 1)
+
+	srv := httptest.NewServer(tuntunhttp.Middleware(NewServer(
+		tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+			if tuntunhttp.RequestFromContext(ctx).URL.Query().Has("limit") {
+				_, err := io.ReadAll(conn)
+				readErr <- err
+				return err
+			}
+
+			return echo(t, toWrite)(ctx, conn)
+		}),
+		WithOriginPatterns("trusted.test"),
+		WithReadLimit(16),
+		WithCompressionMode(websocket.CompressionContextTakeover),
+		WithPreAccept(func(r *http.Request) error {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				return &RejectError{Status: http.StatusUnauthorized, Reason: "missing token"}
+			}
+			return nil
+		}),
+	)))
+	t.Cleanup(srv.Close)
+
+	withOrigin := func(origin string) ClientOption {
+		return WithHeader("Origin", origin)
+	}
+	auth := WithHeader("Authorization", "Bearer token")
+
+	t.Run("pre accept", func(t *testing.T) {
+		_, res, err := NewClient(srv.URL).Connect(t.Context())
+		require.Error(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		_, res, err := NewClient(srv.URL, auth, withOrigin("http://evil.test")).Connect(t.Context())
+		require.Error(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		conn, _, err := NewClient(srv.URL, auth, withOrigin("http://trusted.test")).Connect(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		roundtrip(t, conn, toWrite)
+	})
+
+	t.Run("compression", func(t *testing.T) {
+		conn, res, err := NewClient(srv.URL, auth, WithDialOptions(func(opts *websocket.DialOptions) {
+			opts.CompressionMode = websocket.CompressionContextTakeover
+		})).Connect(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		assert.Contains(t, res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+		roundtrip(t, conn, toWrite)
+	})
+
+	t.Run("read limit", func(t *testing.T) {
+		conn, _, err := NewClient(srv.URL+"?limit", auth).Connect(t.Context())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(make([]byte, 100))
+		require.NoError(t, err)
+
+		require.Error(t, <-readErr)
+	})
+}
+
+func TestReadLimitMaxMessageSize(t *testing.T) {
+	read := make(chan int, 1)
+
+	srv := httptest.NewServer(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		b, err := io.ReadAll(conn)
+		read <- len(b)
+		return err
+	}), WithReadLimit(MaxMessageSize)))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := NewClient(srv.URL).Connect(t.Context())
+	require.NoError(t, err)
+
+	_, err = conn.Write(make([]byte, 1024*1024))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	assert.Equal(t, 1024*1024, <-read)
+}
+
+func TestPing(t *testing.T) {
+	serverErr := make(chan error, 1)
+
+	srv := httptest.NewServer(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := io.ReadAll(conn)
+		serverErr <- err
+		return err
+	}), WithPing(20*time.Millisecond, 50*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithClientPing(0, 0)).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// pongs are sent while reading, the conn outlives many ping intervals
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	select {
+	case err := <-serverErr:
+		t.Fatalf("unexpected server error: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ws, _, err := websocket.Dial(t.Context(), srv.URL, &websocket.DialOptions{Subprotocols: []string{SubProtocol}})
+	require.NoError(t, err)
+	defer ws.CloseNow()
+
+	// a peer never reading leaves the pings unanswered
+	require.ErrorIs(t, <-serverErr, ErrPingTimeout)
+}
+
+func TestPingBackpressure(t *testing.T) {
+	const size = 1024 * 1024
+
+	serverErr := make(chan error, 1)
+
+	srv := httptest.NewServer(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		// the pongs are not read while the conn is not
+		time.Sleep(200 * time.Millisecond)
+
+		_, err := io.ReadFull(conn, make([]byte, size))
+		serverErr <- err
+		return err
+	}), WithPing(20*time.Millisecond, 50*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL, WithClientPing(0, 0)).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write(make([]byte, size))
+	}()
+
+	require.NoError(t, <-serverErr)
+}
+
+func TestAddrs(t *testing.T) {
+	addrs := make(chan [2]net.Addr, 1)
+
+	srv := httptest.NewServer(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		c := conn.(net.Conn)
+		addrs <- [2]net.Addr{c.LocalAddr(), c.RemoteAddr()}
+
+		return nil
+	})))
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	serverAddrs := <-addrs
+
+	assert.Equal(t, srv.Listener.Addr().String(), conn.RemoteAddr().String())
+	assert.Equal(t, srv.Listener.Addr().String(), serverAddrs[0].String())
+	assert.Equal(t, conn.LocalAddr().String(), serverAddrs[1].String())
+}
+
+func TestDeadlines(t *testing.T) {
+	srv := httptest.NewServer(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		_, err := io.Copy(conn, conn)
+		return err
+	})))
+	t.Cleanup(srv.Close)
+
+	conn, err := NewClient(srv.URL).Open(t.Context())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the passed deadline left writes alone, and can be extended
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestCloseStatus(t *testing.T) {
+	srv := httptest.NewServer(tuntunhttp.Middleware(NewServer(tuntuntun.HandlerFunc(func(ctx context.Context, conn io.ReadWriteCloser) error {
+		status := websocket.StatusPolicyViolation
+		if tuntunhttp.RequestFromContext(ctx).URL.Query().Has("restart") {
+			status = websocket.StatusGoingAway
+		}
+
+		return conn.(*Conn).CloseWithStatus(status, "bye")
+	}))))
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		query     string
+		code      websocket.StatusCode
+		retryable bool
+	}{
+		{"", websocket.StatusPolicyViolation, false},
+		{"?restart", websocket.StatusGoingAway, true},
+	} {
+		conn, err := NewClient(srv.URL + tc.query).Open(t.Context())
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 1))
+
+		var cerr *CloseError
+		require.ErrorAs(t, err, &cerr)
+		assert.Equal(t, tc.code, cerr.Code)
+		assert.Equal(t, "bye", cerr.Reason)
+		assert.Equal(t, tc.retryable, IsRetryable(err))
+
+		conn.Close()
+	}
+}
+
+// h2Server serves h over h2c and HTTP/1.1, counting the accepted connections.
+func h2Server(t *testing.T, h http.Handler) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return srv, &conns
+}
+
+func TestHTTP2(t *testing.T) {
+	if !ExtendedConnectEnabled() {
+		// extended CONNECT is enabled from the environment, on init
+		cmd := exec.CommandContext(t.Context(), os.Args[0], "-test.run=^TestHTTP2$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG="+os.Getenv("GODEBUG")+",http2xconnect=1")
+
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Contains(t, string(out), "--- PASS: TestHTTP2")
+
+		return
+	}
+
+	toWrite := "hello"
+
+	var protos sync.Map
+	h := newServer(echo(t, toWrite))
+
+	srv, conns := h2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.Proto, true)
+		h.ServeHTTP(w, r)
+	}))
+
+	c := NewClient(srv.URL, WithHTTP2(nil))
+
+	var g errgroup.Group
+	for range 10 {
+		g.Go(func() error {
+			conn, err := c.Open(t.Context())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			roundtrip(t, conn, toWrite)
+
+			_, err = conn.Read(make([]byte, 1))
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("expected EOF, got %w", err)
+			}
+
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	_, h1 := protos.Load("HTTP/1.1")
+	assert.False(t, h1)
+	assert.Equal(t, int64(1), conns.Load())
+}
+
+func TestHTTP2Fallback(t *testing.T) {
+	toWrite := "hello"
+
+	var protos sync.Map
+	h := newServer(echo(t, toWrite))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.Proto, true)
+		h.ServeHTTP(w, r)
+	})
+
+	for _, h2 := range []bool{true, false} {
+		t.Run(fmt.Sprint("h2=", h2), func(t *testing.T) {
+			protos.Clear()
+
+			var srv *httptest.Server
+			if h2 {
+				// without extended CONNECT
+				srv, _ = h2Server(t, handler)
+			} else {
+				srv = httptest.NewServer(handler)
+				t.Cleanup(srv.Close)
+			}
+
+			c := NewClient(srv.URL, WithHTTP2(nil))
+
+			conn, err := c.Open(t.Context())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			roundtrip(t, conn, toWrite)
+
+			_, h1 := protos.Load("HTTP/1.1")
+			assert.True(t, h1)
+
+			// the answer is kept for the next conns
+			assert.True(t, c.fallenBack())
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv, _ := h2Server(t, handler)
+		srv.Close()
+
+		c := NewClient(srv.URL, WithHTTP2(nil))
+
+		_, err := c.Open(t.Context())
+		require.Error(t, err)
+
+		// failing to reach the server says nothing of its support
+		assert.False(t, c.fallenBack())
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+
+		c := NewClient("http://"+l.Addr().String(), WithHTTP2(nil))
+
+		_, err = c.Open(t.Context())
+		require.Error(t, err)
+
+		// losing the conn says nothing of the server support either
+		assert.False(t, c.fallenBack())
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		srv, _ := h2Server(t, handler)
+
+		c := NewClient(srv.URL, WithHTTP2(nil))
+		c.h2Retry = 50 * time.Millisecond
+
+		conn, err := c.Open(t.Context())
+		require.NoError(t, err)
+		conn.Close()
+		require.True(t, c.fallenBack())
+
+		until := c.h1Until.Load()
+
+		// HTTP/2 is tried again once the fallback expired
+		require.Eventually(t, func() bool {
+			return !c.fallenBack()
+		}, 5*time.Second, 10*time.Millisecond)
+
+		conn, err = c.Open(t.Context())
+		require.NoError(t, err)
+		conn.Close()
+
+		// refused again, for another interval
+		assert.True(t, c.fallenBack())
+		assert.Greater(t, c.h1Until.Load(), until)
+	})
+}
+
+func TestExtendedConnectSetting(t *testing.T) {
+	for godebug, enabled := range map[string]bool{
+		"":                                 false,
+		"http2xconnect=1":                  true,
+		"http2xconnect=0":                  false,
+		"http2debug=1,http2xconnect=1":     true,
+		"http2xconnect=1,http2xconnect=0":  false,
+		"http2xconnect=0, http2xconnect=1": true,
+		"xhttp2xconnect=1":                 false,
+	} {
+		assert.Equal(t, enabled, extendedConnectSetting(godebug), godebug)
+	}
+}